@@ -76,10 +76,13 @@ func main() {
 		Addr    string
 		Domains string
 		APIKey  string
+		TLS     TLSConfig
 	}
 
 	flag.StringVar(&conf.Addr, "addr", ":8000", "The server addr.")
 	flag.StringVar(&conf.APIKey, "api-key", os.Getenv("WORKOS_API_KEY"), "The WorkOS API key.")
+	registerTLSFlags(&conf.TLS)
+	flag.Parse()
 
 	log.Printf("launching admin portal demo with configuration: %+v", conf)
 
@@ -90,7 +93,7 @@ func main() {
 	http.HandleFunc("/provision-enterprise", ProvisionEnterprise)
 	http.HandleFunc("/admin-portal", HandlePortal)
 
-	if err := http.ListenAndServe(conf.Addr, nil); err != nil {
+	if err := listenAndServe(conf.Addr, nil, conf.TLS); err != nil {
 		log.Panic(err)
 	}
 }
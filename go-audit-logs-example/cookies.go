@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// CookieConfig sets the attributes of the session cookie.
+type CookieConfig struct {
+	// Secure is "auto", "true" or "false". Auto marks cookies secure when
+	// the server is served over HTTPS.
+	Secure   string
+	HTTPOnly bool
+	SameSite string
+	Domain   string
+	MaxAge   int
+}
+
+func registerCookieFlags(c *CookieConfig) {
+	secure, sameSite, maxAge := os.Getenv("COOKIE_SECURE"), os.Getenv("COOKIE_SAME_SITE"), 86400*30
+	if secure == "" {
+		secure = "auto"
+	}
+	if sameSite == "" {
+		sameSite = "lax"
+	}
+	if v, err := strconv.Atoi(os.Getenv("COOKIE_MAX_AGE")); err == nil {
+		maxAge = v
+	}
+
+	flag.StringVar(&c.Secure, "cookie-secure", secure, "Mark the session cookie secure: auto (when serving HTTPS), true or false.")
+	flag.BoolVar(&c.HTTPOnly, "cookie-http-only", os.Getenv("COOKIE_HTTP_ONLY") != "false", "Hide the session cookie from JavaScript.")
+	flag.StringVar(&c.SameSite, "cookie-same-site", sameSite, "The SameSite attribute of the session cookie: lax, strict, none or default.")
+	flag.StringVar(&c.Domain, "cookie-domain", os.Getenv("COOKIE_DOMAIN"), "The domain of the session cookie, defaults to the host of the request.")
+	flag.IntVar(&c.MaxAge, "cookie-max-age", maxAge, "How many seconds the session cookie lasts, 0 for a browser session.")
+}
+
+// Options returns the session options. https tells whether the server is
+// served over HTTPS.
+func (c CookieConfig) Options(https bool) (*sessions.Options, error) {
+	opts := &sessions.Options{
+		Path:     "/",
+		Domain:   c.Domain,
+		MaxAge:   c.MaxAge,
+		HttpOnly: c.HTTPOnly,
+	}
+
+	switch strings.ToLower(c.Secure) {
+	case "auto":
+		opts.Secure = https
+	case "true":
+		opts.Secure = true
+	case "false":
+	default:
+		return nil, fmt.Errorf("invalid cookie secure value %q", c.Secure)
+	}
+
+	switch strings.ToLower(c.SameSite) {
+	case "lax":
+		opts.SameSite = http.SameSiteLaxMode
+	case "strict":
+		opts.SameSite = http.SameSiteStrictMode
+	case "none":
+		// Browsers reject SameSite=None cookies that aren't secure.
+		if !opts.Secure {
+			return nil, fmt.Errorf("cookie same site none requires a secure cookie")
+		}
+		opts.SameSite = http.SameSiteNoneMode
+	case "default":
+		opts.SameSite = http.SameSiteDefaultMode
+	default:
+		return nil, fmt.Errorf("invalid cookie same site value %q", c.SameSite)
+	}
+
+	if c.MaxAge < 0 {
+		return nil, fmt.Errorf("invalid cookie max age %d", c.MaxAge)
+	}
+
+	return opts, nil
+}
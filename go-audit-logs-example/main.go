@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -23,6 +24,12 @@ var router = http.NewServeMux()
 var key = []byte("super-secret-key")
 var store = sessions.NewCookieStore(key)
 
+var conf struct {
+	Addr    string
+	TLS     TLSConfig
+	Cookies CookieConfig
+}
+
 type SendEventData struct {
 	Name       string
 	ID         string
@@ -305,6 +312,18 @@ func events(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	flag.StringVar(&conf.Addr, "addr", ":8000", "The server addr.")
+	registerTLSFlags(&conf.TLS)
+	registerCookieFlags(&conf.Cookies)
+	flag.Parse()
+
+	opts, err := conf.Cookies.Options(conf.TLS.Enabled())
+	if err != nil {
+		log.Fatal("Error in cookie options: ", err)
+	}
+	store.Options = opts
+	store.MaxAge(opts.MaxAge)
+
 	auditlogs.SetAPIKey(os.Getenv("WORKOS_API_KEY"))
 	organizations.SetAPIKey(os.Getenv("WORKOS_API_KEY"))
 	portal.SetAPIKey(os.Getenv("WORKOS_API_KEY"))
@@ -321,7 +340,7 @@ func main() {
 	router.HandleFunc("/export-events", exportEvents)
 	router.HandleFunc("/logout", logout)
 
-	if err := http.ListenAndServe(":8000", router); err != nil {
+	if err := listenAndServe(conf.Addr, router, conf.TLS); err != nil {
 		log.Panic(err)
 	}
 }
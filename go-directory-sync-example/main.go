@@ -232,10 +232,12 @@ func main() {
 		APIKey    string
 		ProjectID string
 		Directory string
+		TLS       TLSConfig
 	}
 
 	flag.StringVar(&conf.Addr, "addr", ":8000", "The server addr.")
 	flag.StringVar(&conf.APIKey, "api-key", os.Getenv("WORKOS_API_KEY"), "The WorkOS API key.")
+	registerTLSFlags(&conf.TLS)
 	flag.Parse()
 
 	log.Printf("launching directory sync demo with configuration: %+v", conf)
@@ -256,7 +258,7 @@ func main() {
 	images := http.FileServer(http.Dir("./static/images"))
 	http.Handle("/images/", http.StripPrefix("/images/", images))
 
-	if err := http.ListenAndServe(conf.Addr, nil); err != nil {
+	if err := listenAndServe(conf.Addr, nil, conf.TLS); err != nil {
 		log.Panic(err)
 	}
 
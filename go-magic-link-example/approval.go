@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// A magic link can be requested on one device and opened on another. The
+// requesting browser waits for the link on a page showing a pairing code and
+// is told over Server-Sent Events when the link is opened. The device that
+// opened it shows the same code and asks the user to approve the sign-in,
+// after which the waiting browser signs in. Comparing the codes keeps a
+// phisher who requested a link for the user's address from getting it
+// approved.
+
+// The statuses of a pending login.
+const (
+	// pendingWaiting is waiting for the link to be opened.
+	pendingWaiting = "waiting"
+
+	// pendingOpened has had its link opened on another device, which is
+	// asked to approve the sign-in.
+	pendingOpened = "opened"
+
+	pendingApproved = "approved"
+	pendingDenied   = "denied"
+
+	// pendingSignedIn has had its link opened in the requesting browser,
+	// which is signed in.
+	pendingSignedIn = "signed_in"
+
+	pendingExpired = "expired"
+)
+
+// PendingLogin is a magic link request waiting for its link to be opened.
+type PendingLogin struct {
+	ID          string
+	PairingCode string
+	Email       string
+	ExpiresAt   time.Time
+	Status      string
+
+	// Profile is the JSON profile of the user who opened the link.
+	Profile string
+
+	watchers []chan string
+}
+
+// pendingLogins are kept in memory until they expire.
+var pendingLogins = struct {
+	sync.Mutex
+	logins map[string]*PendingLogin
+}{logins: make(map[string]*PendingLogin)}
+
+// newPendingLogin returns a pending login for a magic link to email. Its ID
+// is the state of the link; it is only kept once the link is sent, see
+// waitForLink.
+func newPendingLogin(email string) *PendingLogin {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Panic(err)
+	}
+
+	return &PendingLogin{
+		ID:          hex.EncodeToString(id),
+		PairingCode: newPairingCode(),
+		Email:       email,
+		ExpiresAt:   time.Now().Add(conf.ApprovalTimeout),
+		Status:      pendingWaiting,
+	}
+}
+
+// waitForLink keeps the pending login of a magic link that was sent, and has
+// this browser wait for it. A browser only waits for its latest link: the
+// login of an earlier one expires, and its link signs in whichever device
+// opens it.
+func waitForLink(w http.ResponseWriter, r *http.Request, login *PendingLogin) {
+	session, _ := store.Get(r, "cookie-name")
+	previous, _ := session.Values["pending_login"].(string)
+
+	pendingLogins.Lock()
+	now := time.Now()
+	for id, l := range pendingLogins.logins {
+		if id == previous || now.After(l.ExpiresAt) {
+			l.setStatus(pendingExpired)
+			delete(pendingLogins.logins, id)
+		}
+	}
+	pendingLogins.logins[login.ID] = login
+	pendingLogins.Unlock()
+
+	session.Values["pending_login"] = login.ID
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+}
+
+// waitingFor returns the pending login this browser is waiting for, if it is
+// for email and its link wasn't opened yet.
+func waitingFor(r *http.Request, email string) (PendingLogin, bool) {
+	session, _ := store.Get(r, "cookie-name")
+	id, _ := session.Values["pending_login"].(string)
+
+	login, ok := pendingLogin(id)
+	if !ok || login.Email != email || login.Status != pendingWaiting {
+		return PendingLogin{}, false
+	}
+
+	return login, true
+}
+
+// stopWaiting ends the wait of a browser that was signed in by opening a
+// magic link, which tells its waiting page.
+func stopWaiting(session *sessions.Session) {
+	if id, _ := session.Values["pending_login"].(string); id != "" {
+		updatePendingLogin(id, pendingWaiting, pendingSignedIn, "")
+		delete(session.Values, "pending_login")
+	}
+}
+
+// pairingAlphabet leaves out the characters that are easily mistaken for
+// one another, like 0 and O.
+const pairingAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// newPairingCode returns a code like "K7M-Q3X".
+func newPairingCode() string {
+	code := make([]byte, 7)
+	for i := range code {
+		if i == 3 {
+			code[i] = '-'
+			continue
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(pairingAlphabet))))
+		if err != nil {
+			log.Panic(err)
+		}
+		code[i] = pairingAlphabet[n.Int64()]
+	}
+	return string(code)
+}
+
+// pendingLogin returns a copy of the pending login with the id, if it
+// hasn't expired.
+func pendingLogin(id string) (PendingLogin, bool) {
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+
+	login, ok := pendingLogins.logins[id]
+	if !ok || time.Now().After(login.ExpiresAt) {
+		return PendingLogin{}, false
+	}
+
+	return *login, true
+}
+
+// updatePendingLogin moves the pending login with the id from status from
+// to status to, and tells its watchers. It reports whether the login was in
+// status from. Signed in logins are forgotten, denied ones are kept until
+// they expire so the waiting browser can still learn what happened.
+func updatePendingLogin(id, from, to, profile string) bool {
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+
+	login, ok := pendingLogins.logins[id]
+	if !ok || login.Status != from || time.Now().After(login.ExpiresAt) {
+		return false
+	}
+
+	if profile != "" {
+		login.Profile = profile
+	}
+	login.setStatus(to)
+
+	if to == pendingSignedIn {
+		delete(pendingLogins.logins, id)
+	}
+
+	return true
+}
+
+// takeApprovedLogin forgets the approved pending login with the id and
+// returns it.
+func takeApprovedLogin(id string) (PendingLogin, bool) {
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+
+	login, ok := pendingLogins.logins[id]
+	if !ok || login.Status != pendingApproved || time.Now().After(login.ExpiresAt) {
+		return PendingLogin{}, false
+	}
+
+	delete(pendingLogins.logins, id)
+	return *login, true
+}
+
+// setStatus sets the status and sends it to the watchers, closing them
+// when the login is done with. pendingLogins must be locked.
+func (l *PendingLogin) setStatus(status string) {
+	l.Status = status
+
+	done := status != pendingWaiting && status != pendingOpened
+	for _, ch := range l.watchers {
+		select {
+		case ch <- status:
+		default:
+		}
+		if done {
+			close(ch)
+		}
+	}
+	if done {
+		l.watchers = nil
+	}
+}
+
+// watchPendingLogin returns the current status of the pending login and a
+// channel receiving its later statuses, which is closed once it is done
+// with, or nil when it already is. stop stops watching.
+func watchPendingLogin(id string) (status string, ch <-chan string, stop func()) {
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+
+	login, ok := pendingLogins.logins[id]
+	if !ok || time.Now().After(login.ExpiresAt) {
+		return pendingExpired, nil, func() {}
+	}
+	if login.Status != pendingWaiting && login.Status != pendingOpened {
+		return login.Status, nil, func() {}
+	}
+
+	c := make(chan string, 4)
+	login.watchers = append(login.watchers, c)
+
+	return login.Status, c, func() {
+		pendingLogins.Lock()
+		defer pendingLogins.Unlock()
+
+		for i, w := range login.watchers {
+			if w == c {
+				login.watchers = append(login.watchers[:i], login.watchers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// waitingEvents streams the status of the browser's pending login as
+// Server-Sent Events, starting with its current status, until it is done
+// with. EventSource reconnects by itself when the stream is cut.
+func waitingEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	id, _ := session.Values["pending_login"].(string)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	status, ch, stop := watchPendingLogin(id)
+	defer stop()
+
+	send := func(status string) {
+		fmt.Fprintf(w, "event: status\ndata: %s\n\n", status)
+		flusher.Flush()
+	}
+
+	send(status)
+	if ch == nil {
+		return
+	}
+
+	login, _ := pendingLogin(id)
+	expired := time.NewTimer(time.Until(login.ExpiresAt))
+	defer expired.Stop()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case status, ok := <-ch:
+			if !ok {
+				return
+			}
+			send(status)
+		case <-expired.C:
+			send(pendingExpired)
+			return
+		case <-heartbeat.C:
+			// Keeps proxies from closing the idle connection.
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// completeLogin signs in the waiting browser once its pending login has
+// been approved on the other device.
+func completeLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	id, _ := session.Values["pending_login"].(string)
+
+	login, ok := takeApprovedLogin(id)
+	if !ok {
+		http.Error(w, "This sign-in was not approved, please request a new magic link.", http.StatusForbidden)
+		return
+	}
+
+	startAuthenticatedSession(session, login.Email, login.Profile)
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	log.Printf("%s signed in from another device", login.Email)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// ApprovalPage is rendered by static/approve.html.
+type ApprovalPage struct {
+	ID          string
+	Email       string
+	PairingCode string
+
+	// Status is empty until the user approves or denies the sign-in.
+	Status string
+}
+
+// openedElsewhere handles a magic link of a pending login opened on another
+// device than the one that requested it: it asks the user to approve the
+// sign-in of the requesting browser.
+func openedElsewhere(w http.ResponseWriter, r *http.Request, session *sessions.Session, login PendingLogin, profile string) {
+	if !updatePendingLogin(login.ID, pendingWaiting, pendingOpened, profile) {
+		http.Error(w, "This magic link was already used, please request a new one.", http.StatusConflict)
+		return
+	}
+
+	// Only this device may approve the sign-in.
+	session.Values["approving"] = login.ID
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	renderApproval(w, ApprovalPage{ID: login.ID, Email: login.Email, PairingCode: login.PairingCode})
+}
+
+// approve approves or denies the sign-in of a pending login, depending on
+// the decision parameter.
+func approve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	id := r.FormValue("id")
+	if approving, _ := session.Values["approving"].(string); id == "" || approving != id {
+		http.Error(w, "This sign-in can't be approved from this browser.", http.StatusForbidden)
+		return
+	}
+
+	login, _ := pendingLogin(id)
+
+	status := pendingDenied
+	if r.FormValue("decision") == "approve" {
+		status = pendingApproved
+	}
+	if !updatePendingLogin(id, pendingOpened, status, "") {
+		status = pendingExpired
+	}
+
+	delete(session.Values, "approving")
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	log.Printf("sign-in of %s from another device: %s", login.Email, status)
+	renderApproval(w, ApprovalPage{ID: id, Email: login.Email, PairingCode: login.PairingCode, Status: status})
+}
+
+func renderApproval(w http.ResponseWriter, page ApprovalPage) {
+	tmpl := template.Must(template.ParseFiles("./static/approve.html"))
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/workos/workos-go/v3/pkg/passwordless"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// fakeWorkOS creates passwordless sessions whose link carries a code, and
+// exchanges the code for a profile of the session's address.
+type fakeWorkOS struct {
+	mu     sync.Mutex
+	n      int
+	emails map[string]string
+}
+
+func (f *fakeWorkOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out interface{}
+	switch r.URL.Path {
+	case "/passwordless/sessions":
+		var opts passwordless.CreateSessionOpts
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f.n++
+		code := fmt.Sprintf("code_%d", f.n)
+		f.emails[code] = opts.Email
+
+		out = passwordless.PasswordlessSession{
+			ID:        fmt.Sprintf("passwordless_session_%d", f.n),
+			Email:     opts.Email,
+			ExpiresAt: time.Now().Add(15 * time.Minute).Format(time.RFC3339),
+			Link:      opts.RedirectURI + "?" + url.Values{"code": {code}, "state": {opts.State}}.Encode(),
+		}
+	case "/sso/token":
+		code := r.FormValue("code")
+		email, ok := f.emails[code]
+		if !ok {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		delete(f.emails, code)
+
+		out = sso.ProfileAndToken{
+			AccessToken: "token",
+			Profile:     sso.Profile{ID: "prof_" + code, Email: email, ConnectionType: "MagicLink"},
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(out)
+}
+
+// newMagicLinkServer serves the magic link routes of the app against a fake
+// WorkOS API for the rest of the test, and returns the mailer the links are
+// sent with.
+func newMagicLinkServer(t *testing.T) (*httptest.Server, *testMailer) {
+	workos := httptest.NewServer(&fakeWorkOS{emails: make(map[string]string)})
+	t.Cleanup(workos.Close)
+
+	savedPasswordless, savedSSO, savedRedirect := passwordless.DefaultClient.Endpoint, sso.DefaultClient.Endpoint, conf.RedirectURI
+	t.Cleanup(func() {
+		passwordless.DefaultClient.Endpoint, sso.DefaultClient.Endpoint, conf.RedirectURI = savedPasswordless, savedSSO, savedRedirect
+	})
+	passwordless.SetAPIKey("sk_test")
+	sso.Configure("sk_test", "client_test")
+	passwordless.DefaultClient.Endpoint = workos.URL
+	sso.DefaultClient.Endpoint = workos.URL
+
+	m := &testMailer{}
+	useMailer(t, m)
+
+	server := newTestServer(t, map[string]http.HandlerFunc{
+		"/passwordless-auth": passwordlessAuth,
+		"/success":           success,
+		"/account":           RequireAuth(account),
+		"/waiting/events":    waitingEvents,
+		"/waiting/complete":  completeLogin,
+		"/approve":           approve,
+	})
+	conf.RedirectURI = server.URL + "/success"
+
+	return server, m
+}
+
+// requestLink requests a magic link for the address and returns it.
+func requestLink(t *testing.T, server *httptest.Server, client *http.Client, m *testMailer, email string) *url.URL {
+	res, err := client.PostForm(server.URL+"/passwordless-auth", url.Values{"email": {email}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("requesting a magic link returned %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if len(m.links) == 0 {
+		t.Fatal("no magic link was sent")
+	}
+
+	link, err := url.Parse(m.links[len(m.links)-1].Link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+// watchWaitingPage follows the status of the browser's pending login like
+// its waiting page does, and returns the statuses as they come.
+func watchWaitingPage(t *testing.T, server *httptest.Server, client *http.Client) <-chan string {
+	res, err := client.Get(server.URL + "/waiting/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	statuses := make(chan string, 8)
+	go func() {
+		defer close(statuses)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			if status := strings.TrimPrefix(scanner.Text(), "data: "); status != scanner.Text() {
+				statuses <- status
+			}
+		}
+	}()
+
+	return statuses
+}
+
+func nextStatus(t *testing.T, statuses <-chan string, want string) {
+	t.Helper()
+
+	select {
+	case status := <-statuses:
+		if status != want {
+			t.Fatalf("waiting page got status %q, want %q", status, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waiting page got no status, want %q", want)
+	}
+}
+
+func post(t *testing.T, client *http.Client, u string, form url.Values) int {
+	res, err := client.PostForm(u, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func getStatus(t *testing.T, client *http.Client, u string) int {
+	res, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestApprovalSameDevice(t *testing.T) {
+	server, m := newMagicLinkServer(t)
+	browser := newClient(t)
+
+	link := requestLink(t, server, browser, m, "ada@example.com")
+	statuses := watchWaitingPage(t, server, browser)
+	nextStatus(t, statuses, pendingWaiting)
+
+	if status := getStatus(t, browser, link.String()); status != http.StatusSeeOther {
+		t.Fatalf("opening the link returned %d, want %d", status, http.StatusSeeOther)
+	}
+	nextStatus(t, statuses, pendingSignedIn)
+
+	if status := getStatus(t, browser, server.URL+"/account"); status != http.StatusOK {
+		t.Errorf("account returned %d, want the signed in page", status)
+	}
+}
+
+func TestApprovalOtherDevice(t *testing.T) {
+	tests := []struct {
+		decision string
+		status   string
+		complete int
+	}{
+		{"approve", pendingApproved, http.StatusSeeOther},
+		{"deny", pendingDenied, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.decision, func(t *testing.T) {
+			server, m := newMagicLinkServer(t)
+			browser, phone := newClient(t), newClient(t)
+
+			link := requestLink(t, server, browser, m, "ada@example.com")
+			statuses := watchWaitingPage(t, server, browser)
+			nextStatus(t, statuses, pendingWaiting)
+
+			id := link.Query().Get("state")
+			login, _ := pendingLogin(id)
+
+			// The phone is asked to approve, showing the pairing code.
+			res, err := phone.Get(link.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var page strings.Builder
+			bufio.NewReader(res.Body).WriteTo(&page)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || !strings.Contains(page.String(), login.PairingCode) {
+				t.Fatalf("opening the link on another device returned %d without the pairing code %s", res.StatusCode, login.PairingCode)
+			}
+			nextStatus(t, statuses, pendingOpened)
+
+			// Only the device that opened the link may decide.
+			if status := post(t, browser, server.URL+"/approve", url.Values{"id": {id}, "decision": {"approve"}}); status != http.StatusForbidden {
+				t.Fatalf("approving from the waiting browser returned %d, want %d", status, http.StatusForbidden)
+			}
+
+			if status := post(t, phone, server.URL+"/approve", url.Values{"id": {id}, "decision": {test.decision}}); status != http.StatusOK {
+				t.Fatalf("deciding returned %d, want %d", status, http.StatusOK)
+			}
+			nextStatus(t, statuses, test.status)
+
+			if status := post(t, browser, server.URL+"/waiting/complete", nil); status != test.complete {
+				t.Fatalf("completing the login returned %d, want %d", status, test.complete)
+			}
+
+			signedIn := http.StatusSeeOther
+			if test.decision == "approve" {
+				signedIn = http.StatusOK
+			}
+			if status := getStatus(t, browser, server.URL+"/account"); status != signedIn {
+				t.Errorf("account in the waiting browser returned %d, want %d", status, signedIn)
+			}
+			if status := getStatus(t, phone, server.URL+"/account"); status != http.StatusSeeOther {
+				t.Errorf("the device that opened the link was signed in")
+			}
+		})
+	}
+}
+
+func TestApprovalExpired(t *testing.T) {
+	server, m := newMagicLinkServer(t)
+	browser, phone := newClient(t), newClient(t)
+
+	link := requestLink(t, server, browser, m, "ada@example.com")
+	id := link.Query().Get("state")
+
+	if status := getStatus(t, phone, link.String()); status != http.StatusOK {
+		t.Fatalf("opening the link on another device returned %d, want %d", status, http.StatusOK)
+	}
+
+	pendingLogins.Lock()
+	pendingLogins.logins[id].ExpiresAt = time.Now().Add(-time.Second)
+	pendingLogins.Unlock()
+
+	if status := post(t, phone, server.URL+"/approve", url.Values{"id": {id}, "decision": {"approve"}}); status != http.StatusOK {
+		t.Fatalf("approving returned %d, want %d", status, http.StatusOK)
+	}
+	if status := post(t, browser, server.URL+"/waiting/complete", nil); status != http.StatusForbidden {
+		t.Errorf("completing an expired login returned %d, want %d", status, http.StatusForbidden)
+	}
+	if status := getStatus(t, browser, server.URL+"/account"); status != http.StatusSeeOther {
+		t.Errorf("the waiting browser was signed in after the approval expired")
+	}
+}
+
+func TestApprovalEarlierLink(t *testing.T) {
+	server, m := newMagicLinkServer(t)
+	emailThrottle = &Throttle{}
+	browser := newClient(t)
+
+	first := requestLink(t, server, browser, m, "ada@example.com")
+	firstStatuses := watchWaitingPage(t, server, browser)
+	nextStatus(t, firstStatuses, pendingWaiting)
+
+	// The browser now waits for the second link only.
+	requestLink(t, server, browser, m, "ada@example.com")
+	nextStatus(t, firstStatuses, pendingExpired)
+	statuses := watchWaitingPage(t, server, browser)
+	nextStatus(t, statuses, pendingWaiting)
+
+	// Opening the first link in the browser still signs it in, and ends
+	// the wait for the second one.
+	if status := getStatus(t, browser, first.String()); status != http.StatusSeeOther {
+		t.Fatalf("opening the first link returned %d, want %d", status, http.StatusSeeOther)
+	}
+	nextStatus(t, statuses, pendingSignedIn)
+
+	if status := getStatus(t, browser, server.URL+"/account"); status != http.StatusOK {
+		t.Errorf("account returned %d, want the signed in page", status)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/workos/workos-go/v3/pkg/passwordless"
+)
+
+// MagicLinkEmail is a magic link to email.
+type MagicLinkEmail struct {
+	To        string
+	Link      string
+	ExpiresAt time.Time
+
+	// SessionID is the passwordless session the link signs in to.
+	SessionID string
+
+	// Locale selects the translation of the email, eg. "fr".
+	Locale string
+}
+
+// CodeEmail is a one-time sign in code to email.
+type CodeEmail struct {
+	To        string
+	Code      string
+	ExpiresAt time.Time
+
+	// Locale selects the translation of the email, eg. "fr".
+	Locale string
+}
+
+// Mailer sends magic link and sign in code emails.
+type Mailer interface {
+	SendMagicLink(ctx context.Context, email MagicLinkEmail) error
+	SendCode(ctx context.Context, email CodeEmail) error
+
+	// SendsCodes reports whether SendCode works. Users are only offered
+	// codes when it does.
+	SendsCodes() bool
+}
+
+// newMailer returns the mailer selected by name.
+func newMailer(name string) (Mailer, error) {
+	switch name {
+	case "workos":
+		return workosMailer{}, nil
+	case "smtp":
+		return newSMTPMailer(conf.SMTPAddr, conf.SMTPUsername, conf.SMTPPassword, conf.MailFrom, conf.MailTemplates)
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", name)
+	}
+}
+
+// mailer sends the magic links and codes requested on the login page.
+var mailer Mailer
+
+// workosMailer has WorkOS email the link. WorkOS only emails the links of
+// its own passwordless sessions, so it can't send codes.
+type workosMailer struct{}
+
+func (workosMailer) SendMagicLink(ctx context.Context, email MagicLinkEmail) error {
+	return passwordless.SendSession(ctx, passwordless.SendSessionOpts{
+		SessionID: email.SessionID,
+	})
+}
+
+func (workosMailer) SendCode(ctx context.Context, email CodeEmail) error {
+	return fmt.Errorf("the workos mailer can't send sign in codes, use the smtp mailer")
+}
+
+func (workosMailer) SendsCodes() bool {
+	return false
+}
+
+// defaultLocale is used when no template matches the locale of an email.
+const defaultLocale = "en"
+
+// mailTemplate renders an email in one locale. The text template defines
+// the subject in a "subject" block.
+type mailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// loadMailTemplates loads the templates of the email of that name in every
+// locale in dir, named <name>.<locale>.txt and <name>.<locale>.html.
+func loadMailTemplates(dir, name string) (map[string]mailTemplate, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, name+".*.txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]mailTemplate)
+	for _, path := range paths {
+		locale := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), name+"."), ".txt")
+
+		text, err := texttemplate.ParseFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		if text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("%s does not define a subject", path)
+		}
+
+		html, err := htmltemplate.ParseFiles(filepath.Join(dir, name+"."+locale+".html"))
+		if err != nil {
+			return nil, err
+		}
+
+		templates[strings.ToLower(locale)] = mailTemplate{text, html}
+	}
+
+	if _, ok := templates[defaultLocale]; !ok {
+		return nil, fmt.Errorf("no %s %s template in %s", defaultLocale, name, dir)
+	}
+
+	return templates, nil
+}
+
+// smtpMailer renders emails from templates and sends them through an SMTP
+// server.
+type smtpMailer struct {
+	addr  string
+	auth  smtp.Auth
+	from  *mail.Address
+	links map[string]mailTemplate
+	codes map[string]mailTemplate
+}
+
+func newSMTPMailer(addr, username, password, from, templateDir string) (*smtpMailer, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("the smtp mailer needs an SMTP server")
+	}
+
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %s", from, err)
+	}
+
+	links, err := loadMailTemplates(templateDir, "magic_link")
+	if err != nil {
+		return nil, err
+	}
+	codes, err := loadMailTemplates(templateDir, "code")
+	if err != nil {
+		return nil, err
+	}
+
+	m := &smtpMailer{addr: addr, from: sender, links: links, codes: codes}
+	if username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m, nil
+}
+
+// localeTemplate returns the template of the locale, of its language, or of
+// the default locale.
+func localeTemplate(templates map[string]mailTemplate, locale string) mailTemplate {
+	locale = strings.ToLower(locale)
+	if t, ok := templates[locale]; ok {
+		return t
+	}
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		if t, ok := templates[locale[:i]]; ok {
+			return t
+		}
+	}
+	return templates[defaultLocale]
+}
+
+func (m *smtpMailer) SendMagicLink(ctx context.Context, email MagicLinkEmail) error {
+	return m.send(email.To, localeTemplate(m.links, email.Locale), email)
+}
+
+func (m *smtpMailer) SendCode(ctx context.Context, email CodeEmail) error {
+	return m.send(email.To, localeTemplate(m.codes, email.Locale), email)
+}
+
+func (m *smtpMailer) SendsCodes() bool {
+	return true
+}
+
+// send renders the template with data and emails it to the address to.
+func (m *smtpMailer) send(to string, t mailTemplate, data interface{}) error {
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid email address %q: %s", to, err)
+	}
+
+	msg, err := m.render(rcpt, t, data)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.addr, m.auth, m.from.Address, []string{rcpt.Address}, msg)
+}
+
+// render builds the message, with a plaintext and an HTML alternative.
+func (m *smtpMailer) render(rcpt *mail.Address, t mailTemplate, data interface{}) ([]byte, error) {
+	var subject, text, html bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := t.html.Execute(&html, data); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", rcpt)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", m.messageID())
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n", mw.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+// messageID returns a new Message-ID in the domain of the sender.
+func (m *smtpMailer) messageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	domain := m.from.Address[strings.LastIndex(m.from.Address, "@")+1:]
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+// requestLocale returns the locale the user asked for with the locale
+// parameter, or the first language their browser accepts.
+func requestLocale(r *http.Request) string {
+	if locale := r.FormValue("locale"); locale != "" {
+		return locale
+	}
+
+	accept := r.Header.Get("Accept-Language")
+	if i := strings.IndexByte(accept, ','); i >= 0 {
+		accept = accept[:i]
+	}
+	if i := strings.IndexByte(accept, ';'); i >= 0 {
+		accept = accept[:i]
+	}
+	if accept = strings.TrimSpace(accept); accept == "" || accept == "*" {
+		return defaultLocale
+	}
+
+	return accept
+}
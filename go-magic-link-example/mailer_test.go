@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestMailSink starts the mail sink on a free port and returns its addr.
+func startTestMailSink(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	if err := startMailSink(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	return addr
+}
+
+// lastMessage returns the message the mail sink caught last.
+func lastMessage(t *testing.T) Message {
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	if len(outbox.messages) == 0 {
+		t.Fatal("the outbox is empty")
+	}
+
+	return outbox.messages[len(outbox.messages)-1]
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr := startTestMailSink(t)
+
+	m, err := newSMTPMailer(addr, "", "", "Example <login@example.com>", "./templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	err = m.SendMagicLink(context.Background(), MagicLinkEmail{
+		To:        "ada@example.com",
+		Link:      "https://auth.example.com/passwordless/token?token=abc",
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := lastMessage(t)
+	if msg.From != "login@example.com" {
+		t.Errorf("envelope sender %q, want %q", msg.From, "login@example.com")
+	}
+	if len(msg.To) != 1 || msg.To[0] != "ada@example.com" {
+		t.Errorf("envelope recipients %q, want [ada@example.com]", msg.To)
+	}
+	if msg.Subject != "Your sign in link" {
+		t.Errorf("subject %q, want %q", msg.Subject, "Your sign in link")
+	}
+	if !strings.Contains(msg.Text, "sign in as ada@example.com") || !strings.Contains(msg.Text, "until October 18, 09:30 UTC") {
+		t.Errorf("unexpected text body:\n%s", msg.Text)
+	}
+	if msg.HTML == "" {
+		t.Error("the HTML alternative is missing")
+	}
+	if len(msg.Links) != 1 || msg.Links[0] != "https://auth.example.com/passwordless/token?token=abc" {
+		t.Errorf("links %q, want only the magic link", msg.Links)
+	}
+
+	raw, err := mail.ReadMessage(bytes.NewReader([]byte(msg.Raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{
+		"From":         `"Example" <login@example.com>`,
+		"To":           "<ada@example.com>",
+		"MIME-Version": "1.0",
+	}
+	for name, want := range headers {
+		if got := raw.Header.Get(name); got != want {
+			t.Errorf("%s header %q, want %q", name, got, want)
+		}
+	}
+	if id := raw.Header.Get("Message-Id"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Message-ID header %q, want one in the sender's domain", id)
+	}
+	if _, err := raw.Header.Date(); err != nil {
+		t.Errorf("invalid Date header: %s", err)
+	}
+	if ct := raw.Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/alternative; boundary=") {
+		t.Errorf("Content-Type header %q, want multipart/alternative", ct)
+	}
+}
+
+func TestSMTPMailerLocale(t *testing.T) {
+	addr := startTestMailSink(t)
+
+	m, err := newSMTPMailer(addr, "", "", "login@example.com", "./templates/email")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.SendCode(context.Background(), CodeEmail{
+		To:        "ada@example.com",
+		Code:      "123456",
+		ExpiresAt: time.Now().Add(10 * time.Minute),
+		Locale:    "fr-CA",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := lastMessage(t)
+	if want := "Votre code de connexion"; !strings.HasPrefix(msg.Subject, want) {
+		t.Errorf("subject %q, want the French one starting with %q", msg.Subject, want)
+	}
+	if !strings.Contains(msg.Text, "123456") {
+		t.Errorf("the text body doesn't contain the code:\n%s", msg.Text)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is an email caught by the mail sink.
+type Message struct {
+	ID         int
+	ReceivedAt time.Time
+	From       string
+	To         []string
+	Subject    string
+	Text       string
+	HTML       string
+	Links      []string
+	Raw        string
+}
+
+// outboxSize is how many messages the outbox keeps.
+const outboxSize = 100
+
+// maxMessageSize is the largest message the mail sink accepts.
+const maxMessageSize = 10 << 20
+
+// outbox keeps the messages caught by the mail sink, in memory.
+var outbox struct {
+	sync.Mutex
+	messages []Message
+	lastID   int
+}
+
+func addMessage(m Message) int {
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	outbox.lastID++
+	m.ID = outbox.lastID
+	outbox.messages = append(outbox.messages, m)
+	if len(outbox.messages) > outboxSize {
+		outbox.messages = outbox.messages[len(outbox.messages)-outboxSize:]
+	}
+
+	return m.ID
+}
+
+// startMailSink starts an SMTP server on addr that catches every message sent
+// to it in the outbox instead of delivering it.
+func startMailSink(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("catching emails sent to smtp://%s in the outbox", addr)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Printf("mail sink stopped: %s", err)
+				return
+			}
+			go serveSMTP(conn)
+		}
+	}()
+
+	return nil
+}
+
+// serveSMTP speaks just enough SMTP to receive messages.
+func serveSMTP(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	var from string
+	var to []string
+
+	tp.PrintfLine("220 localhost mail sink ready")
+	for {
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			tp.PrintfLine("250 localhost")
+		case "EHLO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250-8BITMIME")
+			tp.PrintfLine("250 SIZE %d", maxMessageSize)
+		case "MAIL":
+			from, to = smtpPath(arg), nil
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			to = append(to, smtpPath(arg))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			if len(to) == 0 {
+				tp.PrintfLine("503 RCPT first")
+				continue
+			}
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+
+			data, err := ioutil.ReadAll(io.LimitReader(tp.DotReader(), maxMessageSize+1))
+			if err != nil {
+				return
+			}
+			if len(data) > maxMessageSize {
+				io.Copy(ioutil.Discard, tp.DotReader())
+				tp.PrintfLine("552 Message too large")
+				continue
+			}
+
+			id := addMessage(parseMessage(from, to, data))
+			log.Printf("mail sink caught message %d to %s", id, strings.Join(to, ", "))
+			tp.PrintfLine("250 OK queued as %d", id)
+			from, to = "", nil
+		case "RSET":
+			from, to = "", nil
+			tp.PrintfLine("250 OK")
+		case "NOOP":
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// smtpPath returns the address of a MAIL FROM:<...> or RCPT TO:<...>
+// argument.
+func smtpPath(arg string) string {
+	if i := strings.IndexByte(arg, '<'); i >= 0 {
+		arg = arg[i+1:]
+		if j := strings.IndexByte(arg, '>'); j >= 0 {
+			arg = arg[:j]
+		}
+	}
+	return arg
+}
+
+var linkPattern = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// parseMessage reads the subject, text and HTML bodies and links of a
+// message. Messages that can't be parsed are kept raw.
+func parseMessage(from string, to []string, data []byte) Message {
+	m := Message{ReceivedAt: time.Now(), From: from, To: to, Raw: string(data)}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		m.Text = string(data)
+		return m
+	}
+
+	dec := new(mime.WordDecoder)
+	if m.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+
+	readPart(&m, textproto.MIMEHeader(msg.Header), msg.Body)
+
+	seen := make(map[string]bool)
+	for _, link := range linkPattern.FindAllString(m.Text+" "+html.UnescapeString(m.HTML), -1) {
+		if !seen[link] {
+			seen[link] = true
+			m.Links = append(m.Links, link)
+		}
+	}
+
+	return m
+}
+
+// readPart fills in the text and HTML bodies of the message from a part,
+// walking into multipart parts.
+func readPart(m *Message, header textproto.MIMEHeader, body io.Reader) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			// NextPart decodes quoted-printable parts itself.
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			readPart(m, part.Header, part)
+		}
+		return
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, newlineStripper{body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case mediaType == "text/plain" && m.Text == "":
+		m.Text = string(data)
+	case mediaType == "text/html" && m.HTML == "":
+		m.HTML = string(data)
+	}
+}
+
+// newlineStripper drops the line breaks of base64 bodies.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (s newlineStripper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	j := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+// outboxURL returns the URL of the outbox on the internal addr, or "" when
+// it isn't served.
+func outboxURL() string {
+	if conf.Mode != modeDev || conf.InternalAddr == "" {
+		return ""
+	}
+
+	host, port, err := net.SplitHostPort(conf.InternalAddr)
+	if err != nil {
+		return ""
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	return "http://" + net.JoinHostPort(host, port) + "/outbox"
+}
+
+// outboxPage lists the messages caught by the mail sink, newest first.
+func outboxPage(w http.ResponseWriter, r *http.Request) {
+	outbox.Lock()
+	messages := make([]Message, 0, len(outbox.messages))
+	for i := len(outbox.messages) - 1; i >= 0; i-- {
+		messages = append(messages, outbox.messages[i])
+	}
+	outbox.Unlock()
+
+	tmpl := template.Must(template.ParseFiles("./static/outbox.html"))
+	if err := tmpl.Execute(w, messages); err != nil {
+		log.Panic(err)
+	}
+}
+
+// outboxMessage shows the message given by the id parameter.
+func outboxMessage(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+
+	outbox.Lock()
+	var message *Message
+	for i := range outbox.messages {
+		if outbox.messages[i].ID == id {
+			m := outbox.messages[i]
+			message = &m
+		}
+	}
+	outbox.Unlock()
+
+	if message == nil {
+		http.Error(w, fmt.Sprintf("message %d not found", id), http.StatusNotFound)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("./static/outbox_message.html"))
+	if err := tmpl.Execute(w, message); err != nil {
+		log.Panic(err)
+	}
+}
+
+// clearOutbox deletes every message caught by the mail sink.
+func clearOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	outbox.Lock()
+	outbox.messages = nil
+	outbox.Unlock()
+
+	http.Redirect(w, r, "/outbox", http.StatusSeeOther)
+}
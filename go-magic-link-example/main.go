@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"flag"
-	"fmt"
+	"html/template"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
-	"text/template"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/workos/workos-go/v3/pkg/passwordless"
@@ -18,6 +21,258 @@ import (
 type Profile struct {
 	Email   string
 	Session string
+
+	// ShowLink is set in development, where the link is shown on the page
+	// instead of only being emailed.
+	ShowLink bool
+
+	// OutboxURL is where emails caught in development can be read.
+	OutboxURL string
+
+	// PairingCode is shown while waiting for the link to be opened, see
+	// approval.go.
+	PairingCode string
+}
+
+// The modes the example runs in.
+const (
+	modeDev  = "dev"
+	modeProd = "prod"
+)
+
+var conf struct {
+	Addr        string
+	APIKey      string
+	ClientID    string
+	RedirectURI string
+	TLS         TLSConfig
+
+	Mode         string
+	MailSinkAddr string
+	InternalAddr string
+
+	Mailer        string
+	SMTPAddr      string
+	SMTPUsername  string
+	SMTPPassword  string
+	MailFrom      string
+	MailTemplates string
+
+	EmailLimit    int
+	EmailWindow   time.Duration
+	EmailCooldown time.Duration
+	IPLimit       int
+	IPWindow      time.Duration
+
+	EmailPolicyFile string
+	ApprovalTimeout time.Duration
+	CodeTTL         time.Duration
+	CodeAttempts    int
+
+	Cookies         CookieConfig
+	SessionKeys     string
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+}
+
+// LoginPage is rendered by static/index.html.
+type LoginPage struct {
+	// Codes is set when users may ask for a code instead of a link.
+	Codes bool
+}
+
+// index serves the login page, and the other files of the static directory.
+func index(files http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		tmpl := template.Must(template.ParseFiles("./static/index.html"))
+		if err := tmpl.Execute(w, LoginPage{Codes: mailer.SendsCodes()}); err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+func passwordlessAuth(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		log.Panic(err)
+	}
+
+	// Checked first so that the request doesn't count against the throttles.
+	if r.FormValue("method") == methodCode && !mailer.SendsCodes() {
+		http.Error(w, "Sign in codes are not available, please request a magic link.", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+
+	if ok, wait := ipThrottle.Allow(clientIP(r), now); !ok {
+		countRequest(requestThrottledIP)
+		log.Printf("throttled magic link request from %s", clientIP(r))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many sign in requests, please try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	check, perr := emailPolicy.Check(r.FormValue("email"))
+	if perr != nil {
+		countRequest(requestDenied)
+		log.Printf("denied magic link request for %q: %s", r.FormValue("email"), perr.Reason)
+		code := http.StatusForbidden
+		if perr.Reason == "invalid_email" {
+			code = http.StatusBadRequest
+		}
+		http.Error(w, perr.Message, code)
+		return
+	}
+	if r.FormValue("method") == methodCode {
+		sendCode(w, r, check, now)
+		return
+	}
+
+	email := check.Email
+
+	// Whether an address is throttled is not revealed, so that requests
+	// can't be used to find out which addresses are in use. A browser that
+	// is still waiting for an earlier link keeps waiting for it.
+	if !allowEmail(check, now) {
+		profile := Profile{Email: email}
+		if login, ok := waitingFor(r, email); ok {
+			profile.PairingCode = login.PairingCode
+		}
+		renderMagicLinkSent(w, profile)
+		return
+	}
+
+	login := newPendingLogin(email)
+
+	opts := passwordless.CreateSessionOpts{
+		Email:       email,
+		Type:        passwordless.MagicLink,
+		RedirectURI: conf.RedirectURI,
+		State:       login.ID,
+	}
+	if org := check.Organization; org != nil {
+		log.Printf("magic link request for %s of organization %s (%s)", email, org.Name, org.ID)
+		opts.Connection = org.Connection
+	}
+
+	session, err := passwordless.CreateSession(context.Background(), opts)
+	if err != nil {
+		log.Printf("creating passwordless session failed: %s", err)
+		countRequest(requestFailed)
+		http.Error(w, "The magic link could not be created.", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt, _ := time.Parse(time.RFC3339, session.ExpiresAt)
+
+	err = mailer.SendMagicLink(r.Context(), MagicLinkEmail{
+		To:        email,
+		Link:      session.Link,
+		ExpiresAt: expiresAt,
+		SessionID: session.ID,
+		Locale:    requestLocale(r),
+	})
+	if err != nil {
+		log.Printf("sending magic link failed: %s", err)
+		countRequest(requestFailed)
+		http.Error(w, "The magic link could not be sent.", http.StatusInternalServerError)
+		return
+	}
+
+	waitForLink(w, r, login)
+	countRequest(requestSent)
+
+	profile := Profile{Email: email, PairingCode: login.PairingCode}
+	if conf.Mode == modeDev {
+		profile.Session = session.Link
+		profile.ShowLink = true
+		profile.OutboxURL = outboxURL()
+	}
+
+	renderMagicLinkSent(w, profile)
+}
+
+func renderMagicLinkSent(w http.ResponseWriter, profile Profile) {
+	tmpl := template.Must(template.ParseFiles("./static/serve_magic_link.html"))
+	if err := tmpl.Execute(w, profile); err != nil {
+		log.Panic(err)
+	}
+}
+
+// success signs the user in with the code of their magic link. When the
+// link was requested by another browser, the user is asked to approve the
+// sign-in of that browser instead.
+func success(w http.ResponseWriter, r *http.Request) {
+	profileAndToken, err := sso.GetProfileAndToken(context.Background(), sso.GetProfileAndTokenOpts{
+		Code: r.URL.Query().Get("code"),
+	})
+	if err != nil {
+		log.Printf("exchanging magic link code failed: %s", err)
+		http.Error(w, "The magic link is invalid or has expired, please request a new one.", http.StatusUnauthorized)
+		return
+	}
+
+	// Use the information in `profile` for further business logic.
+	profile := profileAndToken.Profile
+
+	Raw_profile, err := json.MarshalIndent(profile, "", "    ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+
+	state := r.URL.Query().Get("state")
+	if login, ok := pendingLogin(state); ok {
+		if waiting, _ := session.Values["pending_login"].(string); waiting != state {
+			openedElsewhere(w, r, session, login, string(Raw_profile))
+			return
+		}
+	}
+
+	stopWaiting(session)
+	startAuthenticatedSession(session, profile.Email, string(Raw_profile))
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	log.Printf("%s signed in", profile.Email)
+
+	// Redirecting drops the code from the address bar and the history.
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// AccountPage is rendered by static/account.html.
+type AccountPage struct {
+	Email      string
+	Profile    string
+	SignedInAt time.Time
+	ExpiresAt  time.Time
+}
+
+// account is the signed in user's page.
+func account(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "cookie-name")
+
+	email, _ := session.Values["email"].(string)
+	profile, _ := session.Values["profile"].(string)
+	authenticatedAt, _ := session.Values["authenticated_at"].(int64)
+
+	tmpl := template.Must(template.ParseFiles("./static/account.html"))
+	if err := tmpl.Execute(w, AccountPage{
+		Email:      email,
+		Profile:    profile,
+		SignedInAt: time.Unix(authenticatedAt, 0),
+		ExpiresAt:  sessionExpiresAt(session),
+	}); err != nil {
+		log.Panic(err)
+	}
 }
 
 func main() {
@@ -26,83 +281,165 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
-	var conf struct {
-		Addr        string
-		APIKey      string
-		ClientID    string
-		RedirectURI string
-	}
-
 	flag.StringVar(&conf.Addr, "addr", ":8000", "The server addr.")
 	flag.StringVar(&conf.APIKey, "api-key", os.Getenv("WORKOS_API_KEY"), "The WorkOS API key.")
 	flag.StringVar(&conf.ClientID, "client-id", os.Getenv("WORKOS_CLIENT_ID"), "The WorkOS client id.")
 	flag.StringVar(&conf.RedirectURI, "redirect-uri", os.Getenv("WORKOS_REDIRECT_URI"), "The WorkOS REDIRECT id.")
+	registerTLSFlags(&conf.TLS)
+	flag.StringVar(&conf.Mode, "mode", envOr("MAGIC_LINK_MODE", modeDev), "dev shows magic links on the page and catches emails in the outbox, prod only emails them.")
+	flag.StringVar(&conf.InternalAddr, "internal-addr", envOr("INTERNAL_ADDR", "localhost:8001"), "The addr of the status page and, in dev, the outbox, which are kept off the public addr. Empty to disable them.")
+	flag.StringVar(&conf.MailSinkAddr, "mail-sink-addr", envOr("MAIL_SINK_ADDR", "localhost:2525"), "The SMTP addr of the development mail sink.")
+	flag.StringVar(&conf.Mailer, "mailer", os.Getenv("MAILER"), "Who emails magic links: smtp or workos. Defaults to smtp when an SMTP server is set.")
+	flag.StringVar(&conf.SMTPAddr, "smtp-addr", os.Getenv("SMTP_ADDR"), "The SMTP server magic links are emailed through. Defaults to the mail sink in dev.")
+	flag.StringVar(&conf.SMTPUsername, "smtp-username", os.Getenv("SMTP_USERNAME"), "The SMTP username, if the server requires authentication.")
+	flag.StringVar(&conf.SMTPPassword, "smtp-password", os.Getenv("SMTP_PASSWORD"), "The SMTP password.")
+	flag.StringVar(&conf.MailFrom, "mail-from", envOr("MAIL_FROM", "WorkOS Magic Link <no-reply@example.com>"), "The sender of magic link emails.")
+	flag.StringVar(&conf.MailTemplates, "mail-templates", envOr("MAIL_TEMPLATES", "./templates/email"), "The directory of the magic link email templates.")
+	flag.IntVar(&conf.EmailLimit, "email-limit", 5, "How many magic links an email address may request per -email-window, 0 for no limit.")
+	flag.DurationVar(&conf.EmailWindow, "email-window", time.Hour, "The window of -email-limit.")
+	flag.DurationVar(&conf.EmailCooldown, "email-cooldown", time.Minute, "How long an email address has to wait between magic links.")
+	flag.IntVar(&conf.IPLimit, "ip-limit", 20, "How many magic links an IP address may request per -ip-window, 0 for no limit.")
+	flag.DurationVar(&conf.IPWindow, "ip-window", 10*time.Minute, "The window of -ip-limit.")
+	flag.StringVar(&conf.EmailPolicyFile, "email-policy", os.Getenv("EMAIL_POLICY_FILE"), "A JSON file of the email domains that may request magic links.")
+	flag.DurationVar(&conf.ApprovalTimeout, "approval-timeout", 15*time.Minute, "How long a browser waits for its magic link to be opened on another device.")
+	flag.DurationVar(&conf.CodeTTL, "code-ttl", 10*time.Minute, "How long an emailed sign in code can be used.")
+	flag.IntVar(&conf.CodeAttempts, "code-attempts", 5, "How many wrong sign in codes may be entered before a new code has to be requested.")
+	registerCookieFlags(&conf.Cookies)
+	flag.StringVar(&conf.SessionKeys, "session-keys", os.Getenv("SESSION_KEYS"), "Comma separated session cookie keys, newest first.")
+	flag.DurationVar(&conf.IdleTimeout, "idle-timeout", 30*time.Minute, "How long a signed in session may be inactive before it expires, 0 to disable.")
+	flag.DurationVar(&conf.AbsoluteTimeout, "absolute-timeout", 12*time.Hour, "How long a signed in session lasts regardless of activity, 0 to disable.")
+	flag.Parse()
+
+	if conf.Mode != modeDev && conf.Mode != modeProd {
+		log.Fatalf("Unknown mode %q, expected dev or prod", conf.Mode)
+	}
+	if conf.Mode == modeDev {
+		log.Print("WARNING: running in dev mode, where magic links are shown to whoever requests them. Never expose this server to the internet, run it with -mode prod instead.")
+	}
+	if conf.Mode == modeDev && conf.SMTPAddr == "" {
+		conf.SMTPAddr = conf.MailSinkAddr
+	}
+	if conf.Mailer == "" {
+		conf.Mailer = "workos"
+		if conf.SMTPAddr != "" {
+			conf.Mailer = "smtp"
+		}
+	}
 
-	log.Printf("launching passwordless demo with configuration: %+v", conf)
+	// Secrets are kept out of the log.
+	logged := conf
+	logged.SMTPPassword = redact(logged.SMTPPassword)
+	logged.SessionKeys = redact(logged.SessionKeys)
+	log.Printf("launching passwordless demo with configuration: %+v", logged)
 
-	http.Handle("/", http.FileServer(http.Dir("./static")))
+	cookieOpts, err := conf.Cookies.Options(conf.TLS.Enabled())
+	if err != nil {
+		log.Fatal("Invalid cookie configuration: ", err)
+	}
+	store = newCookieStore(conf.SessionKeys, cookieOpts)
 
 	sso.Configure(conf.APIKey, conf.ClientID)
+	passwordless.SetAPIKey(conf.APIKey)
 
-	http.HandleFunc("/passwordless-auth", func(w http.ResponseWriter, r *http.Request) {
-		passwordless.SetAPIKey(conf.APIKey)
-		if err := r.ParseForm(); err != nil {
-			log.Panic(err)
-		}
+	if mailer, err = newMailer(conf.Mailer); err != nil {
+		log.Fatal("Error creating mailer: ", err)
+	}
+
+	if emailPolicy, err = loadEmailPolicy(conf.EmailPolicyFile); err != nil {
+		log.Fatal("Error loading email policy: ", err)
+	}
 
-		email := r.Form["email"][0]
+	emailThrottle = &Throttle{Max: conf.EmailLimit, Window: conf.EmailWindow, Cooldown: conf.EmailCooldown}
+	ipThrottle = &Throttle{Max: conf.IPLimit, Window: conf.IPWindow}
 
-		session, err := passwordless.CreateSession(context.Background(), passwordless.CreateSessionOpts{
-			Email:       email,
-			Type:        passwordless.MagicLink,
-			RedirectURI: conf.RedirectURI,
-		})
+	http.HandleFunc("/", index(http.FileServer(http.Dir("./static"))))
+	http.HandleFunc("/passwordless-auth", passwordlessAuth)
+	http.HandleFunc("/success", success)
+	http.HandleFunc("/account", RequireAuth(account))
+	http.HandleFunc("/logout", logout)
+	http.HandleFunc("/waiting/events", waitingEvents)
+	http.HandleFunc("/waiting/complete", completeLogin)
+	http.HandleFunc("/approve", approve)
+	http.HandleFunc("/code", codePage)
+	http.HandleFunc("/code/verify", verifyCode)
 
-		if err != nil {
-			fmt.Println(err)
+	// Emails are only caught in dev, where the outbox shows them.
+	if conf.Mode == modeDev {
+		if err := startMailSink(conf.MailSinkAddr); err != nil {
+			log.Fatal("Error starting mail sink: ", err)
 		}
+	}
 
-		err = passwordless.SendSession(context.Background(), passwordless.SendSessionOpts{
-			SessionID: session.ID,
-		})
+	// The status page shows how many addresses are being throttled and the
+	// outbox every magic link sent, which is only for the operators of the
+	// app.
+	if conf.InternalAddr != "" {
+		internal := http.NewServeMux()
+		internal.HandleFunc("/status", status)
+		internal.Handle("/stylesheets/", http.FileServer(http.Dir("./static")))
 
-		if err != nil {
-			fmt.Println(err)
+		if conf.Mode == modeDev {
+			internal.HandleFunc("/outbox", outboxPage)
+			internal.HandleFunc("/outbox/message", outboxMessage)
+			internal.HandleFunc("/outbox/clear", clearOutbox)
 		}
 
-		this_profile := Profile{email, session.Link}
-		tmpl := template.Must(template.ParseFiles("./static/serve_magic_link.html"))
-		if err := tmpl.Execute(w, this_profile); err != nil {
-			log.Panic(err)
+		if err := startInternalServer(conf.InternalAddr, internal); err != nil {
+			log.Fatal("Error starting internal server: ", err)
 		}
-	})
+	}
 
-	http.HandleFunc("/success", func(w http.ResponseWriter, r *http.Request) {
-		profileAndToken, err := sso.GetProfileAndToken(context.Background(), sso.GetProfileAndTokenOpts{
-			Code: r.URL.Query().Get("code"),
-		})
+	if err := listenAndServe(conf.Addr, nil, conf.TLS); err != nil {
+		log.Panic(err)
+	}
+}
 
-		if err != nil {
-			fmt.Println(err)
-		}
+// startInternalServer serves the pages for the operators of the app on addr,
+// which should only be reachable from the machine or a private network.
+func startInternalServer(addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
 
-		// Use the information in `profile` for further business logic.
-		profile := profileAndToken.Profile
+	if host, _, _ := net.SplitHostPort(addr); !isLoopback(host) {
+		log.Printf("WARNING: the internal pages on %s are not limited to localhost", addr)
+	}
+	log.Printf("serving the internal pages on http://%s", addr)
 
-		Raw_profile, err := json.MarshalIndent(profile, "", "    ")
-		if err != nil {
-			log.Println(err)
-			return
+	go func() {
+		if err := http.Serve(l, handler); err != nil {
+			log.Printf("internal server stopped: %s", err)
 		}
+	}()
 
-		tmpl := template.Must(template.ParseFiles("./static/success.html"))
-		if err := tmpl.Execute(w, string(Raw_profile)); err != nil {
-			log.Panic(err)
-		}
-	})
+	return nil
+}
 
-	if err := http.ListenAndServe(conf.Addr, nil); err != nil {
-		log.Panic(err)
+// isLoopback reports whether host only accepts connections from the machine
+// itself.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
 	}
 
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// redact hides a secret configuration value, showing only whether it is set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// envOr returns the value of the environment variable, or def when it is
+// not set.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
 }
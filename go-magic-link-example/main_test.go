@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestMain(m *testing.M) {
+	conf.Mode = modeProd
+	conf.EmailLimit = 5
+	conf.EmailWindow = time.Hour
+	conf.EmailCooldown = time.Minute
+	conf.IPLimit = 20
+	conf.IPWindow = 10 * time.Minute
+	conf.ApprovalTimeout = 15 * time.Minute
+	conf.CodeTTL = 10 * time.Minute
+	conf.CodeAttempts = 5
+
+	store = newCookieStore("test-session-key", &sessions.Options{Path: "/", MaxAge: 30 * 24 * 60 * 60, HttpOnly: true})
+
+	os.Exit(m.Run())
+}
+
+// testMailer keeps the emails it is asked to send.
+type testMailer struct {
+	sync.Mutex
+	codes bool
+	links []MagicLinkEmail
+	sent  []CodeEmail
+}
+
+func (m *testMailer) SendMagicLink(ctx context.Context, email MagicLinkEmail) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.links = append(m.links, email)
+	return nil
+}
+
+func (m *testMailer) SendCode(ctx context.Context, email CodeEmail) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+func (m *testMailer) SendsCodes() bool {
+	return m.codes
+}
+
+// useMailer makes m the mailer for the rest of the test, and resets the
+// throttles and policy so that earlier tests don't get in the way.
+func useMailer(t *testing.T, m Mailer) {
+	savedMailer, savedPolicy := mailer, emailPolicy
+	t.Cleanup(func() {
+		mailer, emailPolicy = savedMailer, savedPolicy
+	})
+
+	mailer = m
+	emailPolicy = &EmailPolicy{PlusAddressing: plusKeep}
+	emailThrottle = &Throttle{Max: conf.EmailLimit, Window: conf.EmailWindow, Cooldown: conf.EmailCooldown}
+	ipThrottle = &Throttle{Max: conf.IPLimit, Window: conf.IPWindow}
+}
+
+// newClient returns a client with its own cookies that doesn't follow
+// redirects.
+func newClient(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// newTestServer serves the handlers of the app for the rest of the test.
+func newTestServer(t *testing.T, routes map[string]http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	for pattern, handler := range routes {
+		mux.HandleFunc(pattern, handler)
+	}
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
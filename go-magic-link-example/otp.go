@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Some mail scanners open every link of an email, which uses up a magic link
+// before the user clicks it. Users can ask for a one-time code instead,
+// which they type in on the code page.
+
+// The ways of signing in the user chooses from on the login page.
+const (
+	methodLink = "link"
+	methodCode = "code"
+)
+
+// codeChallenge is a code that was emailed and not used yet. Only a hash of
+// the code is kept.
+type codeChallenge struct {
+	Email     string
+	Canonical string
+	Hash      [sha256.Size]byte
+	ExpiresAt time.Time
+	Attempts  int
+}
+
+// codeChallenges are kept in memory by ID until they are used, expire or
+// run out of attempts.
+var codeChallenges = struct {
+	sync.Mutex
+	challenges map[string]*codeChallenge
+}{challenges: make(map[string]*codeChallenge)}
+
+var (
+	errCodeExpired = errors.New("code expired")
+	errCodeLocked  = errors.New("too many wrong codes")
+	errCodeWrong   = errors.New("wrong code")
+)
+
+// newCodeChallenge generates a 6-digit code for the address and returns it
+// with the ID of its challenge. Earlier codes of the address stop working.
+func newCodeChallenge(check EmailCheck) (id, code string, expiresAt time.Time) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic(err)
+	}
+	id = hex.EncodeToString(b)
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		log.Panic(err)
+	}
+	code = fmt.Sprintf("%06d", n.Int64())
+
+	now := time.Now()
+	expiresAt = now.Add(conf.CodeTTL)
+
+	codeChallenges.Lock()
+	defer codeChallenges.Unlock()
+
+	for other, c := range codeChallenges.challenges {
+		if c.Canonical == check.Canonical || now.After(c.ExpiresAt) {
+			delete(codeChallenges.challenges, other)
+		}
+	}
+	codeChallenges.challenges[id] = &codeChallenge{
+		Email:     check.Email,
+		Canonical: check.Canonical,
+		Hash:      hashCode(id, code),
+		ExpiresAt: expiresAt,
+	}
+
+	return id, code, expiresAt
+}
+
+func hashCode(id, code string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(id + ":" + code))
+}
+
+// useCode checks the code of the challenge with the id and returns the
+// address it was sent to. A challenge is used up by the right code or by
+// conf.CodeAttempts wrong ones. When the code is wrong, remaining is how
+// many attempts are left.
+func useCode(id, code string) (email string, remaining int, err error) {
+	codeChallenges.Lock()
+	defer codeChallenges.Unlock()
+
+	c, ok := codeChallenges.challenges[id]
+	if !ok || time.Now().After(c.ExpiresAt) {
+		delete(codeChallenges.challenges, id)
+		return "", 0, errCodeExpired
+	}
+
+	hash := hashCode(id, code)
+	if subtle.ConstantTimeCompare(hash[:], c.Hash[:]) == 1 {
+		delete(codeChallenges.challenges, id)
+		return c.Email, 0, nil
+	}
+
+	c.Attempts++
+	if c.Attempts >= conf.CodeAttempts {
+		delete(codeChallenges.challenges, id)
+		return "", 0, errCodeLocked
+	}
+
+	return "", conf.CodeAttempts - c.Attempts, errCodeWrong
+}
+
+// sendCode emails a sign in code to the address and sends the user to the
+// code page. Members of an organization that signs in through a connection
+// must use a magic link, which goes through it.
+func sendCode(w http.ResponseWriter, r *http.Request, check EmailCheck, now time.Time) {
+	if org := check.Organization; org != nil {
+		if org.Connection != "" {
+			countRequest(requestDenied)
+			log.Printf("denied sign in code for %s of organization %s (%s): connection_required", check.Email, org.Name, org.ID)
+			http.Error(w, "Members of "+org.Name+" sign in with a magic link.", http.StatusForbidden)
+			return
+		}
+		log.Printf("sign in code request for %s of organization %s (%s)", check.Email, org.Name, org.ID)
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	session.Values["code_email"] = check.Email
+
+	// A throttled address is sent to the code page like any other, where
+	// an earlier code still works.
+	if allowEmail(check, now) {
+		id, code, expiresAt := newCodeChallenge(check)
+
+		err := mailer.SendCode(r.Context(), CodeEmail{
+			To:        check.Email,
+			Code:      code,
+			ExpiresAt: expiresAt,
+			Locale:    requestLocale(r),
+		})
+		if err != nil {
+			log.Printf("sending sign in code failed: %s", err)
+			countRequest(requestFailed)
+			http.Error(w, "The sign in code could not be sent.", http.StatusInternalServerError)
+			return
+		}
+
+		countRequest(requestSent)
+		session.Values["code_challenge"] = id
+	}
+
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	// Redirecting keeps a reload of the page from sending another code.
+	http.Redirect(w, r, "/code", http.StatusSeeOther)
+}
+
+// CodePage is rendered by static/code.html.
+type CodePage struct {
+	Email string
+	Error string
+
+	// Expired is set when the code can't be used anymore and a new one has
+	// to be requested.
+	Expired bool
+
+	// OutboxURL is set in development, where emails are caught in the
+	// outbox.
+	OutboxURL string
+}
+
+func renderCodePage(w http.ResponseWriter, status int, page CodePage) {
+	page.OutboxURL = outboxURL()
+
+	tmpl := template.Must(template.ParseFiles("./static/code.html"))
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Panic(err)
+	}
+}
+
+// codePage asks for the code that was emailed.
+func codePage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "cookie-name")
+	email, _ := session.Values["code_email"].(string)
+	if email == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	renderCodePage(w, http.StatusOK, CodePage{Email: email})
+}
+
+// verifyCode signs the user in when the code they entered is right.
+func verifyCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	id, _ := session.Values["code_challenge"].(string)
+	page := CodePage{}
+	page.Email, _ = session.Values["code_email"].(string)
+
+	// Codes are often pasted as "123 456" or with surrounding spaces.
+	code := strings.Map(func(c rune) rune {
+		if c == ' ' || c == '-' {
+			return -1
+		}
+		return c
+	}, strings.TrimSpace(r.FormValue("code")))
+
+	email, remaining, err := useCode(id, code)
+	switch err {
+	case nil:
+	case errCodeWrong:
+		log.Printf("wrong sign in code for %s, %d attempts left", page.Email, remaining)
+		page.Error = fmt.Sprintf("That code isn't right, you have %d attempts left.", remaining)
+		if remaining == 1 {
+			page.Error = "That code isn't right, you have 1 attempt left."
+		}
+		renderCodePage(w, http.StatusUnauthorized, page)
+		return
+	case errCodeLocked:
+		log.Printf("too many wrong sign in codes for %s", page.Email)
+		page.Error = "Too many wrong codes. Request a new code to try again."
+		page.Expired = true
+		renderCodePage(w, http.StatusUnauthorized, page)
+		return
+	default:
+		page.Error = "This code has expired. Request a new code to try again."
+		page.Expired = true
+		renderCodePage(w, http.StatusUnauthorized, page)
+		return
+	}
+
+	profile, err := json.MarshalIndent(map[string]string{
+		"email":          email,
+		"sign_in_method": methodCode,
+	}, "", "    ")
+	if err != nil {
+		log.Panic(err)
+	}
+
+	startAuthenticatedSession(session, email, string(profile))
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	log.Printf("%s signed in with a code", email)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var adaCheck = EmailCheck{Email: "Ada@example.com", Canonical: "ada@example.com", Domain: "example.com"}
+
+// wrongCode returns a code that isn't code.
+func wrongCode(code string) string {
+	if code == "000000" {
+		return "000001"
+	}
+	return "000000"
+}
+
+func TestUseCode(t *testing.T) {
+	id, code, _ := newCodeChallenge(adaCheck)
+
+	if _, remaining, err := useCode(id, wrongCode(code)); err != errCodeWrong || remaining != conf.CodeAttempts-1 {
+		t.Fatalf("wrong code returned %v with %d attempts left, want %v with %d", err, remaining, errCodeWrong, conf.CodeAttempts-1)
+	}
+
+	email, _, err := useCode(id, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email != adaCheck.Email {
+		t.Errorf("code was sent to %q, want %q", email, adaCheck.Email)
+	}
+
+	// Codes can only be used once.
+	if _, _, err := useCode(id, code); err != errCodeExpired {
+		t.Errorf("used code returned %v, want %v", err, errCodeExpired)
+	}
+}
+
+func TestUseCodeAttempts(t *testing.T) {
+	id, code, _ := newCodeChallenge(adaCheck)
+
+	for i := 1; i < conf.CodeAttempts; i++ {
+		if _, remaining, err := useCode(id, wrongCode(code)); err != errCodeWrong || remaining != conf.CodeAttempts-i {
+			t.Fatalf("wrong code %d returned %v with %d attempts left, want %v with %d", i, err, remaining, errCodeWrong, conf.CodeAttempts-i)
+		}
+	}
+
+	if _, _, err := useCode(id, wrongCode(code)); err != errCodeLocked {
+		t.Fatalf("last wrong code returned %v, want %v", err, errCodeLocked)
+	}
+
+	// Once locked, the right code doesn't work either.
+	if _, _, err := useCode(id, code); err != errCodeExpired {
+		t.Errorf("right code after too many wrong ones returned %v, want %v", err, errCodeExpired)
+	}
+}
+
+func TestUseCodeExpired(t *testing.T) {
+	id, code, expiresAt := newCodeChallenge(adaCheck)
+	if ttl := time.Until(expiresAt); ttl > conf.CodeTTL || ttl < conf.CodeTTL-time.Minute {
+		t.Errorf("code expires in %s, want %s", ttl, conf.CodeTTL)
+	}
+
+	codeChallenges.Lock()
+	codeChallenges.challenges[id].ExpiresAt = time.Now().Add(-time.Second)
+	codeChallenges.Unlock()
+
+	if _, _, err := useCode(id, code); err != errCodeExpired {
+		t.Errorf("expired code returned %v, want %v", err, errCodeExpired)
+	}
+}
+
+func TestNewCodeChallengeInvalidatesEarlierCodes(t *testing.T) {
+	firstID, firstCode, _ := newCodeChallenge(adaCheck)
+	otherID, otherCode, _ := newCodeChallenge(EmailCheck{Email: "grace@example.com", Canonical: "grace@example.com"})
+
+	// A tagged address is the same address.
+	tagged := adaCheck
+	tagged.Email = "ada+news@example.com"
+	secondID, secondCode, _ := newCodeChallenge(tagged)
+
+	if _, _, err := useCode(firstID, firstCode); err != errCodeExpired {
+		t.Errorf("earlier code of the address returned %v, want %v", err, errCodeExpired)
+	}
+	if email, _, err := useCode(secondID, secondCode); err != nil || email != tagged.Email {
+		t.Errorf("new code returned %q and %v, want %q", email, err, tagged.Email)
+	}
+	if _, _, err := useCode(otherID, otherCode); err != nil {
+		t.Errorf("code of another address returned %v", err)
+	}
+}
+
+func TestCodeOffer(t *testing.T) {
+	server := newTestServer(t, map[string]http.HandlerFunc{
+		"/":                  index(http.FileServer(http.Dir("./static"))),
+		"/passwordless-auth": passwordlessAuth,
+	})
+
+	connected := Organization{ID: "org_sso", Name: "SSO Corp", Domains: []string{"sso.example.com"}, Connection: "conn_XXXX"}
+	plain := Organization{ID: "org_plain", Name: "Plain Corp", Domains: []string{"plain.example.com"}}
+
+	tests := []struct {
+		name   string
+		codes  bool
+		email  string
+		status int
+		sent   int
+	}{
+		{"mailer can't send codes", false, "ada@example.com", http.StatusBadRequest, 0},
+		{"mailer sends codes", true, "ada@example.com", http.StatusSeeOther, 1},
+		{"organization without a connection", true, "ada@plain.example.com", http.StatusSeeOther, 1},
+		{"organization with a connection", true, "ada@sso.example.com", http.StatusForbidden, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &testMailer{codes: test.codes}
+			useMailer(t, m)
+			emailPolicy.AllowDomains = []string{"example.com"}
+			emailPolicy.Organizations = []Organization{connected, plain}
+			client := newClient(t)
+
+			res, err := client.Get(server.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if offered := strings.Contains(string(body), `value="code"`); offered != test.codes {
+				t.Errorf("login page offers codes: %t, want %t", offered, test.codes)
+			}
+
+			res, err = client.PostForm(server.URL+"/passwordless-auth", url.Values{
+				"email":  {test.email},
+				"method": {methodCode},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("requesting a code returned %d, want %d", res.StatusCode, test.status)
+			}
+			if len(m.sent) != test.sent {
+				t.Errorf("%d codes were sent, want %d", len(m.sent), test.sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// EmailPolicy decides which email addresses may request a magic link.
+type EmailPolicy struct {
+	// AllowDomains lists the domains that may sign in, along with the
+	// domains of Organizations. When both are empty, every domain that
+	// isn't blocked may sign in. A domain also matches its subdomains.
+	AllowDomains []string `json:"allow_domains"`
+
+	// BlockDomains lists the domains that may never sign in.
+	BlockDomains []string `json:"block_domains"`
+
+	// BlockDisposable blocks the domains of disposable email providers,
+	// listed one per line in DisposableDomainsFile.
+	BlockDisposable       bool   `json:"block_disposable"`
+	DisposableDomainsFile string `json:"disposable_domains_file"`
+
+	// PlusAddressing is what is done with the +tag of an address like
+	// ada+news@example.com: "keep" sends the link to it as is, "strip"
+	// sends it to ada@example.com and "reject" refuses the address. Either
+	// way, tagged addresses are throttled together with the untagged one.
+	PlusAddressing string `json:"plus_addressing"`
+
+	// Organizations map email domains to WorkOS organizations.
+	Organizations []Organization `json:"organizations"`
+
+	disposable map[string]bool
+}
+
+// Organization is a customer whose members sign in with their work email.
+type Organization struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+
+	// Connection is the WorkOS connection members sign in through, if any.
+	Connection string `json:"connection,omitempty"`
+}
+
+// The ways PlusAddressing handles tagged addresses.
+const (
+	plusKeep   = "keep"
+	plusStrip  = "strip"
+	plusReject = "reject"
+)
+
+// emailPolicy is loaded from conf.EmailPolicyFile at startup. By default
+// every valid address may sign in.
+var emailPolicy = &EmailPolicy{PlusAddressing: plusKeep}
+
+func loadEmailPolicy(path string) (*EmailPolicy, error) {
+	if path == "" {
+		return emailPolicy, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &EmailPolicy{PlusAddressing: plusKeep}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+
+	switch policy.PlusAddressing {
+	case plusKeep, plusStrip, plusReject:
+	default:
+		return nil, fmt.Errorf("invalid plus addressing %q, expected keep, strip or reject", policy.PlusAddressing)
+	}
+
+	if policy.BlockDisposable {
+		if policy.DisposableDomainsFile == "" {
+			policy.DisposableDomainsFile = "./disposable_domains.txt"
+		}
+		if policy.disposable, err = loadDomainList(policy.DisposableDomainsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+// loadDomainList reads a file of domains, one per line. Blank lines and
+// lines starting with # are skipped.
+func loadDomainList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[strings.ToLower(line)] = true
+	}
+
+	return domains, scanner.Err()
+}
+
+// PolicyError is why an address may not request a magic link.
+type PolicyError struct {
+	// Reason is a short code for the request counters, eg. "domain_blocked".
+	Reason string
+
+	// Message is shown to the user.
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason + ": " + e.Message
+}
+
+// EmailCheck is an address that passed the policy.
+type EmailCheck struct {
+	// Email is the address the magic link is sent to, with a lower-cased
+	// domain.
+	Email string
+
+	// Canonical is the lower-cased address without its +tag. Addresses with
+	// the same canonical form are throttled together.
+	Canonical string
+
+	Domain string
+
+	// Organization is the organization of the domain, if any.
+	Organization *Organization
+}
+
+// Check validates and normalizes an address and decides whether it may
+// request a magic link. When it may not, it returns why.
+func (p *EmailPolicy) Check(email string) (EmailCheck, *PolicyError) {
+	email = strings.TrimSpace(email)
+
+	// Only bare addresses are accepted, not "Ada <ada@example.com>".
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return EmailCheck{}, &PolicyError{"invalid_email", "Please enter a valid email address."}
+	}
+
+	at := strings.LastIndexByte(email, '@')
+	local, domain := email[:at], strings.TrimSuffix(strings.ToLower(email[at+1:]), ".")
+	if !validDomain(domain) {
+		return EmailCheck{}, &PolicyError{"invalid_email", "Please enter a valid email address."}
+	}
+
+	base := local
+	if i := strings.IndexByte(local, '+'); i > 0 {
+		base = local[:i]
+
+		switch p.PlusAddressing {
+		case plusStrip:
+			local = base
+		case plusReject:
+			return EmailCheck{}, &PolicyError{"plus_addressing", "Please enter your email address without a +tag."}
+		}
+	}
+
+	check := EmailCheck{
+		Email:     local + "@" + domain,
+		Canonical: strings.ToLower(base) + "@" + domain,
+		Domain:    domain,
+	}
+
+	if matchDomain(p.BlockDomains, domain) {
+		return EmailCheck{}, &PolicyError{"domain_blocked", "Email addresses from " + domain + " can't sign in."}
+	}
+	if p.disposable != nil && p.disposableDomain(domain) {
+		return EmailCheck{}, &PolicyError{"disposable_domain", "Please use your work email address, not a disposable one."}
+	}
+
+	for i := range p.Organizations {
+		if matchDomain(p.Organizations[i].Domains, domain) {
+			check.Organization = &p.Organizations[i]
+			return check, nil
+		}
+	}
+
+	if (len(p.AllowDomains) > 0 || len(p.Organizations) > 0) && !matchDomain(p.AllowDomains, domain) {
+		return EmailCheck{}, &PolicyError{"domain_not_allowed", "Please sign in with the work email address of an onboarded organization."}
+	}
+
+	return check, nil
+}
+
+// disposableDomain reports whether domain or one of its parents is a
+// disposable email provider.
+func (p *EmailPolicy) disposableDomain(domain string) bool {
+	for {
+		if p.disposable[domain] {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// matchDomain reports whether domain is one of domains or a subdomain of
+// one of them.
+func matchDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validDomain reports whether domain is a fully qualified host name, as
+// opposed to an IP literal or a local name.
+func validDomain(domain string) bool {
+	labels := strings.Split(domain, ".")
+	if len(domain) > 253 || len(labels) < 2 {
+		return false
+	}
+	if tld := labels[len(labels)-1]; strings.Trim(tld, "0123456789") == "" {
+		return false
+	}
+
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmailPolicyCheck(t *testing.T) {
+	acme := Organization{ID: "org_acme", Name: "Acme", Domains: []string{"acme.com"}}
+
+	tests := []struct {
+		name   string
+		policy EmailPolicy
+		email  string
+
+		// Either the address passes and is normalized...
+		want      string
+		canonical string
+		org       string
+
+		// ...or it is refused for this reason.
+		reason string
+	}{
+		{name: "valid", email: " Ada@Example.COM ", want: "Ada@example.com", canonical: "ada@example.com"},
+		{name: "display name", email: "Ada <ada@example.com>", reason: "invalid_email"},
+		{name: "no domain", email: "ada@", reason: "invalid_email"},
+		{name: "not an address", email: "ada", reason: "invalid_email"},
+
+		{name: "plus kept", policy: EmailPolicy{PlusAddressing: plusKeep}, email: "Ada+News@example.com", want: "Ada+News@example.com", canonical: "ada@example.com"},
+		{name: "plus stripped", policy: EmailPolicy{PlusAddressing: plusStrip}, email: "Ada+News@example.com", want: "Ada@example.com", canonical: "ada@example.com"},
+		{name: "plus rejected", policy: EmailPolicy{PlusAddressing: plusReject}, email: "ada+news@example.com", reason: "plus_addressing"},
+		{name: "leading plus is not a tag", policy: EmailPolicy{PlusAddressing: plusReject}, email: "+ada@example.com", want: "+ada@example.com", canonical: "+ada@example.com"},
+
+		{name: "allowed domain", policy: EmailPolicy{AllowDomains: []string{"example.com"}}, email: "ada@example.com", want: "ada@example.com", canonical: "ada@example.com"},
+		{name: "allowed subdomain", policy: EmailPolicy{AllowDomains: []string{"Example.com"}}, email: "ada@eu.example.com", want: "ada@eu.example.com", canonical: "ada@eu.example.com"},
+		{name: "lookalike of an allowed domain", policy: EmailPolicy{AllowDomains: []string{"example.com"}}, email: "ada@badexample.com", reason: "domain_not_allowed"},
+		{name: "other domain", policy: EmailPolicy{AllowDomains: []string{"example.com"}}, email: "ada@example.org", reason: "domain_not_allowed"},
+
+		{name: "blocked domain", policy: EmailPolicy{BlockDomains: []string{"example.org"}}, email: "ada@example.org", reason: "domain_blocked"},
+		{name: "blocked subdomain", policy: EmailPolicy{BlockDomains: []string{"example.org"}}, email: "ada@mail.example.org", reason: "domain_blocked"},
+		{name: "blocked before allowed", policy: EmailPolicy{AllowDomains: []string{"example.org"}, BlockDomains: []string{"mail.example.org"}}, email: "ada@mail.example.org", reason: "domain_blocked"},
+
+		{name: "disposable domain", policy: EmailPolicy{disposable: map[string]bool{"mailinator.com": true}}, email: "ada@mailinator.com", reason: "disposable_domain"},
+		{name: "disposable parent", policy: EmailPolicy{disposable: map[string]bool{"mailinator.com": true}}, email: "ada@x.y.mailinator.com", reason: "disposable_domain"},
+		{name: "disposable suffix is not a parent", policy: EmailPolicy{disposable: map[string]bool{"mailinator.com": true}}, email: "ada@notmailinator.com", want: "ada@notmailinator.com", canonical: "ada@notmailinator.com"},
+
+		{name: "organization domain", policy: EmailPolicy{Organizations: []Organization{acme}}, email: "ada@acme.com", want: "ada@acme.com", canonical: "ada@acme.com", org: "org_acme"},
+		{name: "organization subdomain", policy: EmailPolicy{Organizations: []Organization{acme}}, email: "ada@eu.acme.com", want: "ada@eu.acme.com", canonical: "ada@eu.acme.com", org: "org_acme"},
+		{name: "no organization", policy: EmailPolicy{Organizations: []Organization{acme}}, email: "ada@example.com", reason: "domain_not_allowed"},
+		{name: "allowed without organization", policy: EmailPolicy{AllowDomains: []string{"example.com"}, Organizations: []Organization{acme}}, email: "ada@example.com", want: "ada@example.com", canonical: "ada@example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check, perr := test.policy.Check(test.email)
+			if test.reason != "" {
+				if perr == nil {
+					t.Fatalf("Check(%q) passed, want it refused with %s", test.email, test.reason)
+				}
+				if perr.Reason != test.reason {
+					t.Errorf("Check(%q) refused it with %s, want %s", test.email, perr.Reason, test.reason)
+				}
+				return
+			}
+
+			if perr != nil {
+				t.Fatalf("Check(%q) refused it: %s", test.email, perr)
+			}
+			if check.Email != test.want || check.Canonical != test.canonical {
+				t.Errorf("Check(%q) returned %q and canonical %q, want %q and %q", test.email, check.Email, check.Canonical, test.want, test.canonical)
+			}
+
+			org := ""
+			if check.Organization != nil {
+				org = check.Organization.ID
+			}
+			if org != test.org {
+				t.Errorf("Check(%q) found organization %q, want %q", test.email, org, test.org)
+			}
+		})
+	}
+}
+
+func TestValidDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		valid  bool
+	}{
+		{"example.com", true},
+		{"mail.example.co.uk", true},
+		{"xn--bcher-kva.example", true},
+		{"1password.com", true},
+		{"a-b.example.com", true},
+		{"localhost", false},
+		{"127.0.0.1", false},
+		{"[127.0.0.1]", false},
+		{"example..com", false},
+		{".example.com", false},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"exa_mple.com", false},
+		{"Example.com", false},
+		{strings.Repeat("a", 64) + ".com", false},
+		{strings.Repeat("a.", 126) + "com", false},
+	}
+
+	for _, test := range tests {
+		if valid := validDomain(test.domain); valid != test.valid {
+			t.Errorf("validDomain(%q) = %t, want %t", test.domain, valid, test.valid)
+		}
+	}
+}
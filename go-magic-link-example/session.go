@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// store keeps the signed in user in a signed and encrypted cookie. It is
+// created from conf.SessionKeys at startup.
+var store *sessions.CookieStore
+
+// newCookieStore returns a cookie store using the comma separated keys. The
+// first key protects new cookies; all of them are accepted when reading, so
+// a key can be rotated by putting the new key first and dropping the old one
+// once every cookie protected by it has expired.
+func newCookieStore(list string, options *sessions.Options) *sessions.CookieStore {
+	var pairs [][]byte
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			// The key signs the cookie and a key derived from it
+			// encrypts it.
+			block := sha256.Sum256([]byte("encrypt:" + key))
+			pairs = append(pairs, []byte(key), block[:])
+		}
+	}
+
+	if len(pairs) == 0 {
+		log.Print("No session keys configured, using a random key; sessions will not survive a restart")
+		pairs = append(pairs, securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+	}
+
+	s := sessions.NewCookieStore(pairs...)
+	s.Options = options
+	s.MaxAge(options.MaxAge)
+	return s
+}
+
+// revoked lists the IDs of sessions that were signed out, until they would
+// have expired anyway. The session lives in the cookie, so this is what
+// stops a copy of a signed out cookie from being used.
+var revoked = struct {
+	sync.Mutex
+	ids map[string]time.Time
+}{ids: make(map[string]time.Time)}
+
+func revokeSession(id string, until time.Time) {
+	revoked.Lock()
+	defer revoked.Unlock()
+
+	now := time.Now()
+	for id, t := range revoked.ids {
+		if now.After(t) {
+			delete(revoked.ids, id)
+		}
+	}
+	revoked.ids[id] = until
+}
+
+func sessionRevoked(id string) bool {
+	revoked.Lock()
+	defer revoked.Unlock()
+
+	_, ok := revoked.ids[id]
+	return ok
+}
+
+// startAuthenticatedSession signs the user in, replacing whatever the
+// session held. It must be saved by the caller.
+func startAuthenticatedSession(session *sessions.Session, email, profile string) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Panic(err)
+	}
+
+	now := time.Now().Unix()
+	session.Values = map[interface{}]interface{}{
+		"id":               hex.EncodeToString(id),
+		"email":            email,
+		"profile":          profile,
+		"authenticated_at": now,
+		"last_seen_at":     now,
+	}
+}
+
+// sessionExpiresAt returns when a signed in session expires: after
+// conf.IdleTimeout without activity or conf.AbsoluteTimeout after signing
+// in, whichever comes first. It is the zero time when neither is set.
+func sessionExpiresAt(session *sessions.Session) time.Time {
+	authenticatedAt, _ := session.Values["authenticated_at"].(int64)
+	lastSeenAt, _ := session.Values["last_seen_at"].(int64)
+
+	var expiresAt time.Time
+	if conf.AbsoluteTimeout > 0 {
+		expiresAt = time.Unix(authenticatedAt, 0).Add(conf.AbsoluteTimeout)
+	}
+	if conf.IdleTimeout > 0 {
+		if idle := time.Unix(lastSeenAt, 0).Add(conf.IdleTimeout); expiresAt.IsZero() || idle.Before(expiresAt) {
+			expiresAt = idle
+		}
+	}
+
+	return expiresAt
+}
+
+// authenticateSession returns the request session and whether it is signed
+// in. Expired and revoked sessions are cleared. Signed in sessions have
+// their idle timer slid and are saved.
+func authenticateSession(w http.ResponseWriter, r *http.Request) (*sessions.Session, bool) {
+	session, err := store.Get(r, "cookie-name")
+	if err != nil {
+		log.Println(err)
+	}
+
+	id, _ := session.Values["id"].(string)
+	if id == "" {
+		return session, false
+	}
+
+	now := time.Now()
+
+	if expiresAt := sessionExpiresAt(session); sessionRevoked(id) || !expiresAt.IsZero() && now.After(expiresAt) {
+		log.Printf("session expired for %s", r.URL.Path)
+		session.Values = map[interface{}]interface{}{}
+		session.Options.MaxAge = -1
+		if err := session.Save(r, w); err != nil {
+			log.Panic(err)
+		}
+		return session, false
+	}
+
+	session.Values["last_seen_at"] = now.Unix()
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	return session, true
+}
+
+// RequireAuth only lets signed in users through to next. Everyone else is
+// sent to the login page.
+func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authenticateSession(w, r); !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		// Signed in pages must not be served from the cache after logout.
+		w.Header().Set("Cache-Control", "no-store")
+		next(w, r)
+	}
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	if id, _ := session.Values["id"].(string); id != "" {
+		until := sessionExpiresAt(session)
+		if until.IsZero() {
+			until = time.Now().Add(time.Duration(store.Options.MaxAge) * time.Second)
+		}
+		revokeSession(id, until)
+	}
+
+	session.Values = map[interface{}]interface{}{}
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
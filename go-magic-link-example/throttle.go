@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Throttle lets something happen at most Max times per Window, and no sooner
+// than Cooldown after the previous time. A zero Max or Cooldown is not
+// enforced.
+type Throttle struct {
+	Max      int
+	Window   time.Duration
+	Cooldown time.Duration
+
+	mu     sync.Mutex
+	recent map[string][]time.Time
+}
+
+// Allow records an attempt for key. When key is throttled it returns false
+// and how long until the next attempt is allowed, and records nothing.
+func (t *Throttle) Allow(key string, now time.Time) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.recent == nil {
+		t.recent = make(map[string][]time.Time)
+	}
+	t.prune(now)
+
+	times := t.recent[key]
+	if n := len(times); n > 0 && t.Cooldown > 0 {
+		if wait := times[n-1].Add(t.Cooldown).Sub(now); wait > 0 {
+			return false, wait
+		}
+	}
+	if t.Max > 0 && len(times) >= t.Max {
+		return false, times[len(times)-t.Max].Add(t.Window).Sub(now)
+	}
+
+	t.recent[key] = append(times, now)
+	return true, 0
+}
+
+// Tracked returns how many keys have recent attempts.
+func (t *Throttle) Tracked() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(time.Now())
+	return len(t.recent)
+}
+
+// prune forgets the attempts that no longer count against a limit.
+func (t *Throttle) prune(now time.Time) {
+	keep := t.Window
+	if t.Cooldown > keep {
+		keep = t.Cooldown
+	}
+
+	for key, times := range t.recent {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) >= keep {
+			i++
+		}
+		if i == len(times) {
+			delete(t.recent, key)
+		} else {
+			t.recent[key] = times[i:]
+		}
+	}
+}
+
+// emailThrottle and ipThrottle limit magic link requests per email address
+// and per client IP address. They are configured from conf.
+var (
+	emailThrottle *Throttle
+	ipThrottle    *Throttle
+)
+
+// allowEmail reports whether the address may be sent another magic link or
+// code. Throttled requests are counted.
+func allowEmail(check EmailCheck, now time.Time) bool {
+	if ok, _ := emailThrottle.Allow(check.Canonical, now); !ok {
+		countRequest(requestThrottledEmail)
+		log.Printf("throttled sign in request for %s", check.Email)
+		return false
+	}
+
+	return true
+}
+
+// clientIP returns the address the request came from.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+// requestStats count what happened to magic link requests, by outcome.
+var requestStats = struct {
+	sync.Mutex
+	counts map[string]int64
+}{counts: make(map[string]int64)}
+
+// The outcomes of a magic link request.
+const (
+	requestSent           = "sent"
+	requestThrottledIP    = "throttled_ip"
+	requestThrottledEmail = "throttled_email"
+	requestDenied         = "denied"
+	requestFailed         = "failed"
+)
+
+func countRequest(outcome string) {
+	requestStats.Lock()
+	defer requestStats.Unlock()
+
+	requestStats.counts[outcome]++
+}
+
+// StatusPage is rendered by static/status.html.
+type StatusPage struct {
+	StartedAt time.Time
+	Counters  []Counter
+
+	EmailThrottle ThrottleStatus
+	IPThrottle    ThrottleStatus
+}
+
+// Counter is a request counter of the status page.
+type Counter struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+}
+
+// ThrottleStatus describes a throttle on the status page.
+type ThrottleStatus struct {
+	Max      int    `json:"max"`
+	Window   string `json:"window"`
+	Cooldown string `json:"cooldown"`
+	Tracked  int    `json:"tracked"`
+}
+
+func throttleStatus(t *Throttle) ThrottleStatus {
+	return ThrottleStatus{
+		Max:      t.Max,
+		Window:   t.Window.String(),
+		Cooldown: t.Cooldown.String(),
+		Tracked:  t.Tracked(),
+	}
+}
+
+var startedAt = time.Now()
+
+// status shows the magic link request counters and throttles, as JSON with
+// ?format=json.
+func status(w http.ResponseWriter, r *http.Request) {
+	requestStats.Lock()
+	counters := []Counter{}
+	for _, name := range []string{requestSent, requestDenied, requestThrottledEmail, requestThrottledIP, requestFailed} {
+		counters = append(counters, Counter{name, requestStats.counts[name]})
+	}
+	requestStats.Unlock()
+
+	page := StatusPage{
+		StartedAt:     startedAt,
+		Counters:      counters,
+		EmailThrottle: throttleStatus(emailThrottle),
+		IPThrottle:    throttleStatus(ipThrottle),
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"started_at":     page.StartedAt,
+			"counters":       page.Counters,
+			"email_throttle": page.EmailThrottle,
+			"ip_throttle":    page.IPThrottle,
+		})
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("./static/status.html"))
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Panic(err)
+	}
+}
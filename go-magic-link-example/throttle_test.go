@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// attempt is a call to Throttle.Allow, at after the start of the test.
+type attempt struct {
+	key   string
+	after time.Duration
+	ok    bool
+	wait  time.Duration
+}
+
+func TestThrottleAllow(t *testing.T) {
+	tests := []struct {
+		name     string
+		throttle *Throttle
+		attempts []attempt
+	}{
+		{"cooldown", &Throttle{Cooldown: time.Minute}, []attempt{
+			{"ada", 0, true, 0},
+			{"ada", 20 * time.Second, false, 40 * time.Second},
+			{"ada", time.Minute - time.Nanosecond, false, time.Nanosecond},
+			{"ada", time.Minute, true, 0},
+		}},
+		{"window", &Throttle{Max: 3, Window: 10 * time.Minute}, []attempt{
+			{"ada", 0, true, 0},
+			{"ada", time.Minute, true, 0},
+			{"ada", 2 * time.Minute, true, 0},
+			{"ada", 3 * time.Minute, false, 7 * time.Minute},
+			// The oldest attempt no longer counts once it is a window old.
+			{"ada", 10 * time.Minute, true, 0},
+			{"ada", 10*time.Minute + time.Second, false, time.Minute - time.Second},
+			{"ada", 11 * time.Minute, true, 0},
+		}},
+		{"refused attempts are not recorded", &Throttle{Max: 1, Window: time.Minute}, []attempt{
+			{"ada", 0, true, 0},
+			{"ada", 30 * time.Second, false, 30 * time.Second},
+			{"ada", 59 * time.Second, false, time.Second},
+			{"ada", time.Minute, true, 0},
+		}},
+		{"cooldown and window", &Throttle{Max: 2, Window: time.Hour, Cooldown: time.Minute}, []attempt{
+			{"ada", 0, true, 0},
+			{"ada", 30 * time.Second, false, 30 * time.Second},
+			{"ada", time.Minute, true, 0},
+			{"ada", 2 * time.Minute, false, 58 * time.Minute},
+			{"ada", time.Hour, true, 0},
+		}},
+		{"keys", &Throttle{Max: 1, Window: time.Minute}, []attempt{
+			{"ada", 0, true, 0},
+			{"grace", 0, true, 0},
+			{"ada", time.Second, false, 59 * time.Second},
+		}},
+		{"no limit", &Throttle{}, []attempt{
+			{"ada", 0, true, 0},
+			{"ada", 0, true, 0},
+			{"ada", 0, true, 0},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+			for i, a := range test.attempts {
+				ok, wait := test.throttle.Allow(a.key, start.Add(a.after))
+				if ok != a.ok || wait != a.wait {
+					t.Errorf("attempt %d for %s after %s returned %t and %s, want %t and %s", i, a.key, a.after, ok, wait, a.ok, a.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestThrottlePrune(t *testing.T) {
+	throttle := &Throttle{Max: 5, Window: time.Minute, Cooldown: 2 * time.Minute}
+
+	now := time.Now()
+	throttle.Allow("old", now.Add(-3*time.Minute))
+	throttle.Allow("cooling down", now.Add(-90*time.Second))
+	throttle.Allow("recent", now.Add(-time.Second))
+
+	if tracked := throttle.Tracked(); tracked != 2 {
+		t.Errorf("throttle tracks %d keys, want the 2 whose attempts still count", tracked)
+	}
+}
+
+// requestCode asks for a sign in code for the address from the IP address.
+func requestCode(ip, email string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/passwordless-auth", strings.NewReader(url.Values{
+		"email":  {email},
+		"method": {methodCode},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = ip + ":1234"
+
+	w := httptest.NewRecorder()
+	passwordlessAuth(w, r)
+	return w
+}
+
+func TestThrottleEmail(t *testing.T) {
+	m := &testMailer{codes: true}
+	useMailer(t, m)
+	emailPolicy.PlusAddressing = plusStrip
+
+	// The address is throttled whatever its case and +tag, and from any IP
+	// address. Throttled requests look like the others.
+	requests := []struct{ ip, email string }{
+		{"192.0.2.1", "ada@example.com"},
+		{"192.0.2.2", "Ada+news@Example.com"},
+		{"192.0.2.3", "ADA@example.com"},
+	}
+	for _, req := range requests {
+		if w := requestCode(req.ip, req.email); w.Code != http.StatusSeeOther {
+			t.Fatalf("request for %s from %s returned %d, want %d", req.email, req.ip, w.Code, http.StatusSeeOther)
+		}
+	}
+	if len(m.sent) != 1 {
+		t.Errorf("%d codes were sent, want 1", len(m.sent))
+	}
+
+	if w := requestCode("192.0.2.1", "grace@example.com"); w.Code != http.StatusSeeOther {
+		t.Fatalf("request for another address returned %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if len(m.sent) != 2 {
+		t.Errorf("%d codes were sent, want 2", len(m.sent))
+	}
+}
+
+func TestThrottleIP(t *testing.T) {
+	m := &testMailer{codes: true}
+	useMailer(t, m)
+	ipThrottle = &Throttle{Max: 2, Window: 10 * time.Minute}
+
+	for i, email := range []string{"ada@example.com", "grace@example.com"} {
+		if w := requestCode("192.0.2.1", email); w.Code != http.StatusSeeOther {
+			t.Fatalf("request %d returned %d, want %d", i, w.Code, http.StatusSeeOther)
+		}
+	}
+
+	w := requestCode("192.0.2.1", "alan@example.com")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the IP limit returned %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "600" {
+		t.Errorf("Retry-After is %q, want %q", retry, "600")
+	}
+
+	if w := requestCode("192.0.2.2", "alan@example.com"); w.Code != http.StatusSeeOther {
+		t.Errorf("request from another IP address returned %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if len(m.sent) != 3 {
+		t.Errorf("%d codes were sent, want 3", len(m.sent))
+	}
+}
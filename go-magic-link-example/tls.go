@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TLSConfig configures serving over HTTPS.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	// SelfSigned generates a certificate for localhost into CertFile and
+	// KeyFile when they don't exist yet, for development.
+	SelfSigned bool
+
+	// RedirectAddr is where plain HTTP requests are redirected to HTTPS.
+	RedirectAddr string
+}
+
+// Default files of the generated development certificate.
+const (
+	devCertFile = "localhost.pem"
+	devKeyFile  = "localhost-key.pem"
+)
+
+func registerTLSFlags(c *TLSConfig) {
+	flag.StringVar(&c.CertFile, "tls-cert", os.Getenv("TLS_CERT_FILE"), "The PEM certificate to serve HTTPS with.")
+	flag.StringVar(&c.KeyFile, "tls-key", os.Getenv("TLS_KEY_FILE"), "The PEM private key of the certificate.")
+	flag.BoolVar(&c.SelfSigned, "tls-self-signed", os.Getenv("TLS_SELF_SIGNED") == "true", "Serve HTTPS with a generated self-signed certificate for localhost.")
+	flag.StringVar(&c.RedirectAddr, "http-redirect-addr", os.Getenv("HTTP_REDIRECT_ADDR"), "Redirect plain HTTP requests to this addr to HTTPS.")
+}
+
+// Enabled reports whether the server is served over HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.SelfSigned
+}
+
+// listenAndServe serves handler on addr, over HTTPS when c is enabled.
+func listenAndServe(addr string, handler http.Handler, c TLSConfig) error {
+	if !c.Enabled() {
+		return http.ListenAndServe(addr, handler)
+	}
+
+	if c.SelfSigned {
+		if c.CertFile == "" {
+			c.CertFile, c.KeyFile = devCertFile, devKeyFile
+		}
+		if err := ensureSelfSignedCert(c.CertFile, c.KeyFile); err != nil {
+			return err
+		}
+	}
+
+	if c.RedirectAddr != "" {
+		go func() {
+			log.Printf("redirecting http://%s to https", c.RedirectAddr)
+			if err := http.ListenAndServe(c.RedirectAddr, redirectToHTTPS(addr)); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	return server.ListenAndServeTLS(c.CertFile, c.KeyFile)
+}
+
+// redirectToHTTPS redirects requests to the same host and path on the HTTPS
+// server listening on addr.
+func redirectToHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		// 308 keeps the method and body of form posts.
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// ensureSelfSignedCert writes a self-signed certificate for localhost unless
+// certFile and keyFile already hold a certificate that has not expired. It is
+// reused across restarts so browsers only have to accept it once.
+func ensureSelfSignedCert(certFile, keyFile string) error {
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err == nil && time.Now().Before(cert.NotAfter) {
+			return nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"WorkOS example development certificate"}},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+
+	log.Printf("generated a self-signed certificate for localhost in %s", certFile)
+	return nil
+}
@@ -22,8 +22,10 @@ var key = []byte("super-secret-key")
 var store = sessions.NewCookieStore(key)
 
 var conf struct {
-	APIKey string
-	Addr   string
+	APIKey  string
+	Addr    string
+	TLS     TLSConfig
+	Cookies CookieConfig
 }
 
 type Cookie struct {
@@ -226,8 +228,17 @@ func main() {
 	gob.Register([]Cookie{})
 	flag.StringVar(&conf.APIKey, "api-key", os.Getenv("WORKOS_API_KEY"), "The WorkOS API key.")
 	flag.StringVar(&conf.Addr, "addr", ":8000", "The server addr.")
+	registerTLSFlags(&conf.TLS)
+	registerCookieFlags(&conf.Cookies)
 	flag.Parse()
 
+	opts, err := conf.Cookies.Options(conf.TLS.Enabled())
+	if err != nil {
+		log.Fatal("Error in cookie options: ", err)
+	}
+	store.Options = opts
+	store.MaxAge(opts.MaxAge)
+
 	log.Printf("launching mfa demo with configuration: %+v", conf)
 
 	mfa.SetAPIKey(conf.APIKey)
@@ -242,7 +253,7 @@ func main() {
 	router.HandleFunc("/verify-factor", verifyFactor)
 	router.HandleFunc("/clear-session", clearSession)
 
-	if err := http.ListenAndServe(conf.Addr, router); err != nil {
+	if err := listenAndServe(conf.Addr, router, conf.TLS); err != nil {
 		log.Panic(err)
 	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditIdentity identifies a user in the audit log.
+type AuditIdentity struct {
+	UserID int64  `json:"user_id"`
+	Email  string `json:"email"`
+	Name   string `json:"name"`
+}
+
+// AuditEvent is a line of the audit log.
+type AuditEvent struct {
+	Time   time.Time     `json:"time"`
+	Event  string        `json:"event"`
+	Actor  AuditIdentity `json:"actor"`
+	Target AuditIdentity `json:"target"`
+	IP     string        `json:"ip,omitempty"`
+	Reason string        `json:"reason,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+// clientIP returns the address the request came from.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+// writeAudit appends the event to conf.AuditLog as a line of JSON.
+func writeAudit(event AuditEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	file, err := os.OpenFile(conf.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
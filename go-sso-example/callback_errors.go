@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/workos/workos-go/v3/pkg/workos_errors"
+)
+
+// callbackErrorKind groups the ways a login can fail by what the user can do
+// about it.
+type callbackErrorKind string
+
+const (
+	// The user cancelled or was refused by their identity provider.
+	errKindDenied callbackErrorKind = "denied"
+
+	// The SSO connection or organization is misconfigured.
+	errKindConfiguration callbackErrorKind = "configuration"
+
+	// The authorization code expired or was already used.
+	errKindCodeInvalid callbackErrorKind = "code_invalid"
+
+	// WorkOS or the identity provider could not be reached or failed.
+	errKindUnavailable callbackErrorKind = "unavailable"
+
+	// The callback request itself is malformed.
+	errKindInvalidRequest callbackErrorKind = "invalid_request"
+
+	errKindUnknown callbackErrorKind = "unknown"
+)
+
+// CallbackError is a classified login failure.
+type CallbackError struct {
+	Kind callbackErrorKind
+
+	// Code is the error code returned by WorkOS, eg. access_denied.
+	Code        string
+	Description string
+
+	// RequestID identifies failed WorkOS API requests for support.
+	RequestID string
+
+	Err error
+}
+
+func (e *CallbackError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Kind, e.Code)
+	if e.Description != "" {
+		msg += " (" + e.Description + ")"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// providerErrorKinds maps the `error` values WorkOS redirects to the callback
+// with to the kind of failure.
+var providerErrorKinds = map[string]callbackErrorKind{
+	"access_denied": errKindDenied,
+	"profile_not_allowed_outside_organization": errKindDenied,
+	"ambiguous_connection_selector":            errKindConfiguration,
+	"connection_domain_invalid":                errKindConfiguration,
+	"connection_invalid":                       errKindConfiguration,
+	"connection_strategy_invalid":              errKindConfiguration,
+	"connection_unlinked":                      errKindConfiguration,
+	"invalid_connection_selector":              errKindConfiguration,
+	"organization_invalid":                     errKindConfiguration,
+	"oauth_failed":                             errKindUnavailable,
+	"server_error":                             errKindUnavailable,
+	"temporarily_unavailable":                  errKindUnavailable,
+}
+
+// classifyProviderError classifies the `error` and `error_description`
+// parameters of a callback.
+func classifyProviderError(code, description string) *CallbackError {
+	kind, ok := providerErrorKinds[code]
+	if !ok {
+		kind = errKindUnknown
+	}
+
+	return &CallbackError{Kind: kind, Code: code, Description: description}
+}
+
+// classifyExchangeError classifies an error returned by sso.GetProfileAndToken.
+func classifyExchangeError(err error) *CallbackError {
+	var httpErr workos_errors.HTTPError
+	if errors.As(err, &httpErr) {
+		e := &CallbackError{RequestID: httpErr.RequestID, Err: err}
+
+		// Token errors come back as "<error> <error_description>".
+		code := httpErr.Message
+		if i := strings.Index(code, " "); i > 0 {
+			code, e.Description = code[:i], code[i+1:]
+		}
+
+		switch {
+		case code == "invalid_grant":
+			e.Kind, e.Code = errKindCodeInvalid, code
+		case code == "invalid_client" || httpErr.Code == http.StatusUnauthorized:
+			e.Kind, e.Code = errKindConfiguration, "invalid_client"
+		case httpErr.Code >= 500:
+			e.Kind, e.Code = errKindUnavailable, "server_error"
+		default:
+			e.Kind, e.Code = errKindUnknown, code
+		}
+
+		return e
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &CallbackError{Kind: errKindUnavailable, Code: "network_error", Err: err}
+	}
+
+	return &CallbackError{Kind: errKindUnknown, Code: "unknown_error", Err: err}
+}
+
+// renderCallbackError logs a failed login with the connection it was for and
+// tells the user what they can do about it.
+func renderCallbackError(w http.ResponseWriter, e *CallbackError, connection string) {
+	log.Printf("login via %s failed: %s", connection, e)
+
+	page := ErrorPage{
+		Title:     "We couldn't sign you in",
+		RetryURL:  "/signin/",
+		Reference: e.Code,
+	}
+	if e.RequestID != "" {
+		page.Reference += ", request " + e.RequestID
+	}
+
+	status := http.StatusBadRequest
+
+	switch e.Kind {
+	case errKindDenied:
+		page.Title = "Sign in was cancelled"
+		page.Message = "Your identity provider did not allow this sign in. If you expected it to work, you may not have been given access to this application."
+		page.ContactAdmin = e.Code != "access_denied"
+		status = http.StatusForbidden
+	case errKindConfiguration:
+		page.Message = "Single sign-on is not set up correctly for your organization."
+		page.RetryURL = ""
+		page.ContactAdmin = true
+	case errKindCodeInvalid:
+		page.Title = "Your sign in link has expired"
+		page.Message = "This sign in was already completed or took too long. Please sign in again."
+	case errKindUnavailable:
+		page.Message = "Your identity provider or our sign in service is having trouble right now. Please try again in a few minutes."
+		status = http.StatusBadGateway
+	case errKindInvalidRequest:
+		page.Message = "The sign in response was incomplete. Please sign in again."
+	default:
+		page.Message = "Something went wrong while signing you in."
+		page.ContactAdmin = true
+		status = http.StatusInternalServerError
+	}
+
+	if e.Description != "" && e.Kind != errKindUnknown {
+		page.Details = e.Description
+	}
+
+	renderErrorPage(w, status, page)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/workos/workos-go/v3/pkg/organizations"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// Tenant is the organization or connection that users of an email domain
+// sign in with. When both are set the connection wins.
+type Tenant struct {
+	Organization string `json:"organization"`
+	Connection   string `json:"connection"`
+}
+
+type ProviderPicker struct {
+	Email     string
+	Message   string
+	Providers []LoginProvider
+}
+
+// tenants maps lower-cased email domains to tenants. It is loaded from
+// conf.DomainsFile at startup.
+var tenants = map[string]Tenant{}
+
+// loadTenants reads a JSON object mapping email domains to tenants, eg.
+// {"example.com": {"organization": "org_123"}}.
+func loadTenants(path string) (map[string]Tenant, error) {
+	m := map[string]Tenant{}
+	if path == "" {
+		return m, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]Tenant
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	for domain, tenant := range raw {
+		m[strings.ToLower(domain)] = tenant
+	}
+
+	return m, nil
+}
+
+// emailDomain returns the lower-cased domain of a work email address.
+func emailDomain(email string) (string, bool) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", false
+	}
+
+	i := strings.LastIndex(addr.Address, "@")
+	if i < 0 || i == len(addr.Address)-1 {
+		return "", false
+	}
+
+	return strings.ToLower(addr.Address[i+1:]), true
+}
+
+// lookupTenant resolves an email domain to a tenant, first from the mapping
+// file and then, if enabled, from the WorkOS organizations with that domain.
+func lookupTenant(ctx context.Context, domain string) (Tenant, bool, error) {
+	if tenant, ok := tenants[domain]; ok {
+		return tenant, true, nil
+	}
+
+	if !conf.DiscoverOrganizations {
+		return Tenant{}, false, nil
+	}
+
+	list, err := organizations.ListOrganizations(ctx, organizations.ListOrganizationsOpts{
+		Domains: []string{domain},
+	})
+	if err != nil {
+		return Tenant{}, false, err
+	}
+
+	// A domain claimed by several organizations is ambiguous, so let the
+	// user pick a provider instead of guessing.
+	if len(list.Data) != 1 {
+		return Tenant{}, false, nil
+	}
+
+	return Tenant{Organization: list.Data[0].ID}, true, nil
+}
+
+// discover starts the login for the tenant that owns the domain of the
+// submitted email, or shows the provider picker when the domain is unknown.
+func discover(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		log.Panic(err)
+	}
+
+	email := strings.TrimSpace(r.Form.Get("email"))
+
+	domain, ok := emailDomain(email)
+	if !ok {
+		renderProviderPicker(w, email, "Please enter a valid work email address.")
+		return
+	}
+
+	tenant, found, err := lookupTenant(r.Context(), domain)
+	if err != nil {
+		log.Printf("organization lookup for %s failed: %s", domain, err)
+	}
+	if !found {
+		renderProviderPicker(w, email, "We couldn't find single sign-on for "+domain+". Please choose how you'd like to sign in.")
+		return
+	}
+
+	log.Printf("discovered tenant %+v for %s", tenant, domain)
+
+	opts := sso.GetAuthorizationURLOpts{
+		LoginHint:  email,
+		DomainHint: domain,
+	}
+	if tenant.Connection != "" {
+		opts.Connection = tenant.Connection
+	} else {
+		opts.Organization = tenant.Organization
+	}
+
+	startLogin(w, r, opts)
+}
+
+func renderProviderPicker(w http.ResponseWriter, email, message string) {
+	tmpl := template.Must(template.ParseFiles("./static/choose_provider.html"))
+	if err := tmpl.Execute(w, ProviderPicker{email, message, providers.OAuth()}); err != nil {
+		log.Panic(err)
+	}
+}
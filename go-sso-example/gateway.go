@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// identityHeaders describe the signed in user to the upstream. They are
+// always removed from incoming requests so that clients cannot forge them.
+var identityHeaders = []string{
+	"X-Auth-User",
+	"X-Auth-Email",
+	"X-Auth-Name",
+	"X-Auth-Org",
+	"X-Auth-Connection",
+	"X-Auth-Groups",
+	"X-Auth-Roles",
+	"X-Auth-Impersonator",
+}
+
+// setIdentityHeaders describes the user signed in with the session.
+func setIdentityHeaders(h http.Header, session *sessions.Session) {
+	for _, name := range identityHeaders {
+		h.Del(name)
+	}
+
+	profile, ok := sessionSSOProfile(session)
+	if !ok {
+		return
+	}
+
+	h.Set("X-Auth-User", profile.ID)
+	h.Set("X-Auth-Email", profile.Email)
+	h.Set("X-Auth-Name", strings.TrimSpace(profile.FirstName+" "+profile.LastName))
+	h.Set("X-Auth-Org", profile.OrganizationID)
+	h.Set("X-Auth-Connection", profile.ConnectionID)
+	h.Set("X-Auth-Groups", strings.Join(profile.Groups, ","))
+	h.Set("X-Auth-Roles", strings.Join(sessionRoles(session), ","))
+
+	if imp := sessionImpersonation(session); imp != nil {
+		h.Set("X-Auth-Impersonator", imp.Admin.Email)
+	}
+}
+
+// newGateway returns a reverse proxy to upstream that only lets signed in
+// users through and tells the upstream who they are.
+func newGateway(upstream *url.URL) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		director(r)
+		r.Host = upstream.Host
+	}
+
+	return RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "cookie-name")
+
+		// The session cookie is none of the upstream's business.
+		cookies := r.Cookies()
+		r.Header.Del("Cookie")
+		for _, c := range cookies {
+			if c.Name != "cookie-name" {
+				r.AddCookie(c)
+			}
+		}
+
+		setIdentityHeaders(r.Header, session)
+		proxy.ServeHTTP(w, r)
+	}))
+}
+
+// forwardAuth answers the authentication subrequests of nginx's
+// `auth_request` or Traefik's `forwardAuth`: 200 with the identity headers
+// for signed in users, otherwise 401, or for Traefik, which passes the
+// response on to browsers, a redirect to the login page.
+func forwardAuth(w http.ResponseWriter, r *http.Request) {
+	if session, ok := authenticateSession(w, r); ok {
+		setIdentityHeaders(w.Header(), session)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Header.Get("X-Forwarded-Uri") != "" && !isAPIRequest(r) {
+		signin, err := url.Parse(conf.RedirectURI)
+		if err != nil {
+			log.Printf("invalid redirect uri: %s", err)
+			writeUnauthorized(w)
+			return
+		}
+		signin.Path = "/signin/"
+		signin.RawQuery = ""
+		if returnTo := forwardedReturnTo(r, signin.Host); returnTo != "" {
+			signin.RawQuery = url.Values{"return_to": {returnTo}}.Encode()
+		}
+
+		http.Redirect(w, r, signin.String(), http.StatusFound)
+		return
+	}
+
+	writeUnauthorized(w)
+}
+
+// forwardedReturnTo returns the page the proxy was asked for, as described
+// by the X-Forwarded-Host and X-Forwarded-Uri headers, when users signing in
+// on host may be sent back to it.
+func forwardedReturnTo(r *http.Request, host string) string {
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" && !strings.EqualFold(forwarded, host) {
+		return ""
+	}
+
+	returnTo := r.Header.Get("X-Forwarded-Uri")
+	if !allowedReturnTo(returnTo) {
+		return ""
+	}
+
+	return returnTo
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGateway(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := httptest.NewServer(newGateway(upstreamURL))
+	defer gateway.Close()
+
+	client := newClient(t)
+
+	if status, _ := get(t, client, gateway.URL+"/reports"); status != http.StatusSeeOther {
+		t.Fatalf("gateway returned %d before signing in, want %d", status, http.StatusSeeOther)
+	}
+	if got != nil {
+		t.Fatal("a signed out request reached the upstream")
+	}
+
+	signIn(t, client, "saml", "prof_mock_saml")
+
+	req, err := http.NewRequest(http.MethodGet, gateway.URL+"/reports", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Auth-Email", "mallory@example.com")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("gateway returned %d after signing in, want %d", res.StatusCode, http.StatusOK)
+	}
+	if email := got.Get("X-Auth-Email"); email != "ada@example.com" {
+		t.Errorf("upstream got X-Auth-Email %q, want %q", email, "ada@example.com")
+	}
+	if groups := got.Get("X-Auth-Groups"); groups != "Engineering,Admins" {
+		t.Errorf("upstream got X-Auth-Groups %q, want %q", groups, "Engineering,Admins")
+	}
+	if cookie := got.Get("Cookie"); cookie != "" {
+		t.Errorf("upstream got the session cookie: %s", cookie)
+	}
+}
+
+// forwardAuthRequest returns a subrequest of a proxy asking whether the
+// client may see uri on host.
+func forwardAuthRequest(t *testing.T, host, uri string) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, app.URL+"/auth", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("X-Forwarded-Host", host)
+	req.Header.Set("X-Forwarded-Uri", uri)
+	return req
+}
+
+func TestForwardAuth(t *testing.T) {
+	client := newClient(t)
+	appURL, err := url.Parse(app.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := client.Do(forwardAuthRequest(t, appURL.Host, "/logged_in?tab=groups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("auth returned %d before signing in, want %d", res.StatusCode, http.StatusFound)
+	}
+	signin := res.Header.Get("Location")
+	if want := app.URL + "/signin/?return_to=%2Flogged_in%3Ftab%3Dgroups"; signin != want {
+		t.Fatalf("auth redirected to %s, want %s", signin, want)
+	}
+
+	// The user comes back to the page they asked for after signing in.
+	if status, _ := get(t, client, signin); status != http.StatusOK {
+		t.Fatalf("login page returned %d, want %d", status, http.StatusOK)
+	}
+	if returnTo := signIn(t, client, "saml", "prof_mock_saml"); returnTo != "/logged_in?tab=groups" {
+		t.Errorf("signing in returned to %q, want %q", returnTo, "/logged_in?tab=groups")
+	}
+
+	res, err = client.Do(forwardAuthRequest(t, appURL.Host, "/logged_in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("auth returned %d after signing in, want %d", res.StatusCode, http.StatusOK)
+	}
+	if email := res.Header.Get("X-Auth-Email"); email != "ada@example.com" {
+		t.Errorf("auth returned X-Auth-Email %q, want %q", email, "ada@example.com")
+	}
+}
+
+func TestForwardAuthUnauthenticated(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		uri    string
+		accept string
+		status int
+		want   string
+	}{
+		{"nginx", "", "", "text/html", http.StatusUnauthorized, ""},
+		{"api", "", "/api/me", "application/json", http.StatusUnauthorized, ""},
+		{"other host", "evil.example.com", "/logged_in", "text/html", http.StatusFound, app.URL + "/signin/"},
+		{"not allowed", "", "/internal/reports", "text/html", http.StatusFound, app.URL + "/signin/"},
+		{"open redirect", "", "//evil.example.com/", "text/html", http.StatusFound, app.URL + "/signin/"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := forwardAuthRequest(t, test.host, test.uri)
+			req.Header.Set("Accept", test.accept)
+			if test.host == "" {
+				req.Header.Del("X-Forwarded-Host")
+			}
+			if test.uri == "" {
+				req.Header.Del("X-Forwarded-Uri")
+			}
+
+			res, err := newClient(t).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Fatalf("auth returned %d, want %d", res.StatusCode, test.status)
+			}
+			if location := res.Header.Get("Location"); location != test.want {
+				t.Errorf("auth redirected to %q, want %q", location, test.want)
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ module example.com/m/v2
 go 1.16
 
 require (
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
 	github.com/joho/godotenv v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/workos/workos-go/v3 v3.1.0
 )
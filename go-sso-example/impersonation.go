@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// Impersonation is saved in the session of an admin signed in as another
+// user. It keeps the admin's own identity so it can be restored.
+type Impersonation struct {
+	Admin     AuditIdentity
+	Target    AuditIdentity
+	StartedAt time.Time
+	ExpiresAt time.Time
+
+	AdminIdentityID int64
+	AdminRoles      []string
+	AdminFirstName  string
+	AdminLastName   string
+	AdminRawProfile []byte
+	AdminToken      string
+}
+
+func init() {
+	gob.Register(Impersonation{})
+}
+
+// identityValues are the session values that describe who is signed in.
+// They are swapped when an impersonation starts or stops.
+var identityValues = []string{"user_id", "identity_id", "roles", "first_name", "last_name", "raw_profile", "token"}
+
+// sessionImpersonation returns the impersonation in progress in the session,
+// or nil.
+func sessionImpersonation(session *sessions.Session) *Impersonation {
+	imp, ok := session.Values["impersonation"].(Impersonation)
+	if !ok {
+		return nil
+	}
+
+	return &imp
+}
+
+// sessionIdentity identifies the user signed in with the session.
+func sessionIdentity(session *sessions.Session) AuditIdentity {
+	userID, _ := session.Values["user_id"].(int64)
+	identity := AuditIdentity{UserID: userID}
+
+	if profile, ok := sessionSSOProfile(session); ok {
+		identity.Email = profile.Email
+		identity.Name = strings.TrimSpace(profile.FirstName + " " + profile.LastName)
+	}
+
+	return identity
+}
+
+// setSessionUser signs the session in as the user with the given roles,
+// dropping any token issued to the previous user. It must be saved by the
+// caller.
+func setSessionUser(session *sessions.Session, userID int64, profile sso.Profile, roles []string) {
+	for _, key := range identityValues {
+		delete(session.Values, key)
+	}
+
+	session.Values["user_id"] = userID
+	session.Values["roles"] = roles
+	session.Values["first_name"] = profile.FirstName
+	session.Values["last_name"] = profile.LastName
+	session.Values["raw_profile"], _ = json.MarshalIndent(sso.ProfileAndToken{Profile: profile}, "", "    ")
+}
+
+// endImpersonation restores the admin's identity in the session and records
+// why the impersonation ended. It must be saved by the caller.
+func endImpersonation(r *http.Request, session *sessions.Session, reason string) {
+	imp := sessionImpersonation(session)
+	if imp == nil {
+		return
+	}
+
+	delete(session.Values, "impersonation")
+	session.Values["user_id"] = imp.Admin.UserID
+	session.Values["identity_id"] = imp.AdminIdentityID
+	session.Values["roles"] = imp.AdminRoles
+	session.Values["first_name"] = imp.AdminFirstName
+	session.Values["last_name"] = imp.AdminLastName
+	session.Values["raw_profile"] = imp.AdminRawProfile
+	if imp.AdminToken != "" {
+		session.Values["token"] = imp.AdminToken
+	} else {
+		delete(session.Values, "token")
+	}
+
+	log.Printf("user %d stopped impersonating user %d: %s", imp.Admin.UserID, imp.Target.UserID, reason)
+
+	err := writeAudit(AuditEvent{
+		Event:  "impersonation.stopped",
+		Actor:  imp.Admin,
+		Target: imp.Target,
+		IP:     clientIP(r),
+		Reason: reason,
+	})
+	if err != nil {
+		log.Printf("writing audit log failed: %s", err)
+	}
+}
+
+// expireImpersonation ends the impersonation in progress in the session once
+// it has lasted conf.ImpersonationMaxDuration. It must be saved by the
+// caller.
+func expireImpersonation(r *http.Request, session *sessions.Session, now time.Time) {
+	if imp := sessionImpersonation(session); imp != nil && now.After(imp.ExpiresAt) {
+		endImpersonation(r, session, "expired")
+	}
+}
+
+// impersonate signs the admin in as the user given by user_id.
+func impersonate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	admin := sessionIdentity(session)
+
+	if sessionImpersonation(session) != nil {
+		renderError(w, http.StatusConflict, "You are already impersonating a user",
+			"Stop impersonating them before impersonating someone else.")
+		return
+	}
+
+	_, adminIdentityID := sessionUserIDs(session)
+
+	userID, _ := strconv.ParseInt(r.FormValue("user_id"), 10, 64)
+
+	// Linked users are impersonated as the user they are linked to.
+	user, err := users.Get(userID)
+	if err == nil {
+		user, err = resolveUser(user)
+	}
+	if err == errUserNotFound {
+		renderError(w, http.StatusNotFound, "User not found",
+			"Only users that have signed in before can be impersonated.")
+		return
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if user.ID == admin.UserID {
+		renderError(w, http.StatusBadRequest, "You can't impersonate yourself",
+			"Choose another user to impersonate.")
+		return
+	}
+
+	profile := user.Profile()
+	roles := roleRules.Roles(profile)
+
+	// Admins could otherwise hide their actions behind one another.
+	if hasRole(roles, "admin") {
+		renderError(w, http.StatusForbidden, "Admins can't be impersonated",
+			"Only users without the admin role can be impersonated.")
+		return
+	}
+
+	now := time.Now()
+	rawProfile, _ := session.Values["raw_profile"].([]byte)
+	firstName, _ := session.Values["first_name"].(string)
+	lastName, _ := session.Values["last_name"].(string)
+	token, _ := session.Values["token"].(string)
+
+	imp := Impersonation{
+		Admin: admin,
+		Target: AuditIdentity{
+			UserID: user.ID,
+			Email:  user.Email,
+			Name:   strings.TrimSpace(user.FirstName + " " + user.LastName),
+		},
+		StartedAt:       now,
+		ExpiresAt:       now.Add(conf.ImpersonationMaxDuration),
+		AdminIdentityID: adminIdentityID,
+		AdminRoles:      sessionRoles(session),
+		AdminFirstName:  firstName,
+		AdminLastName:   lastName,
+		AdminRawProfile: rawProfile,
+		AdminToken:      token,
+	}
+
+	err = writeAudit(AuditEvent{
+		Event:  "impersonation.started",
+		Actor:  imp.Admin,
+		Target: imp.Target,
+		IP:     clientIP(r),
+	})
+	if err != nil {
+		// Impersonation is only allowed when it can be audited.
+		log.Printf("writing audit log failed: %s", err)
+		renderError(w, http.StatusInternalServerError, "Impersonation is unavailable",
+			"The audit log could not be written. Please try again later.")
+		return
+	}
+
+	setSessionUser(session, user.ID, profile, roles)
+	session.Values["impersonation"] = imp
+
+	if conf.IssueJWT {
+		claims, _ := sessionClaims(session)
+		token, err := issueToken(claims)
+		if err != nil {
+			log.Panic(err)
+		}
+		session.Values["token"] = token
+	}
+
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	log.Printf("user %d started impersonating user %d", admin.UserID, user.ID)
+
+	http.Redirect(w, r, "/logged_in", http.StatusSeeOther)
+}
+
+// stopImpersonating restores the admin's own identity.
+func stopImpersonating(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	if sessionImpersonation(session) == nil {
+		http.Redirect(w, r, "/logged_in", http.StatusSeeOther)
+		return
+	}
+
+	endImpersonation(r, session, "stopped")
+
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+var (
+	errTokenMalformed = errors.New("token is malformed")
+	errTokenKey       = errors.New("token is signed with an unknown key")
+	errTokenSignature = errors.New("token signature is invalid")
+	errTokenExpired   = errors.New("token has expired")
+	errTokenIssuer    = errors.New("token was issued by someone else")
+	errTokenAudience  = errors.New("token is meant for someone else")
+	errTokenNotYet    = errors.New("token is not valid yet")
+)
+
+// tokenLeeway is how far the clock of whoever issued a token may be ahead of
+// ours.
+const tokenLeeway = time.Minute
+
+// Claims are the claims of the tokens issued to signed in users.
+type Claims struct {
+	Issuer         string   `json:"iss,omitempty"`
+	Subject        string   `json:"sub"`
+	Audience       string   `json:"aud,omitempty"`
+	IssuedAt       int64    `json:"iat,omitempty"`
+	NotBefore      int64    `json:"nbf,omitempty"`
+	ExpiresAt      int64    `json:"exp,omitempty"`
+	Email          string   `json:"email"`
+	Name           string   `json:"name,omitempty"`
+	Organization   string   `json:"org,omitempty"`
+	Connection     string   `json:"connection"`
+	ConnectionType string   `json:"connection_type"`
+	Groups         []string `json:"groups,omitempty"`
+	Roles          []string `json:"roles,omitempty"`
+
+	// Actor is the admin acting as the subject while impersonating them.
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Actor identifies who is really acting, as in RFC 8693.
+type Actor struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+}
+
+// profileClaims returns the claims describing the local user signed in with
+// a WorkOS profile and the roles granted to it. The subject is the user ID,
+// which stays the same across the linked profiles of the user.
+func profileClaims(userID int64, profile sso.Profile, roles []string) Claims {
+	return Claims{
+		Subject:        strconv.FormatInt(userID, 10),
+		Email:          profile.Email,
+		Name:           strings.TrimSpace(profile.FirstName + " " + profile.LastName),
+		Organization:   profile.OrganizationID,
+		Connection:     profile.ConnectionID,
+		ConnectionType: string(profile.ConnectionType),
+		Groups:         profile.Groups,
+		Roles:          roles,
+	}
+}
+
+// sessionClaims returns the claims describing the user signed in with the
+// session, and the admin impersonating them if any.
+func sessionClaims(session *sessions.Session) (Claims, bool) {
+	profile, ok := sessionSSOProfile(session)
+	if !ok {
+		return Claims{}, false
+	}
+
+	userID, _ := sessionUserIDs(session)
+	claims := profileClaims(userID, profile, sessionRoles(session))
+
+	if imp := sessionImpersonation(session); imp != nil {
+		claims.Actor = &Actor{Subject: strconv.FormatInt(imp.Admin.UserID, 10), Email: imp.Admin.Email}
+	}
+
+	return claims, true
+}
+
+// signingKey is a private key used to sign tokens.
+type signingKey struct {
+	id        string
+	alg       string
+	private   crypto.Signer
+	retiredAt time.Time
+}
+
+// keyID derives a stable key ID from the public key.
+func keyID(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:16]), nil
+}
+
+func newSigningKey(private crypto.Signer) (*signingKey, error) {
+	var alg string
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case ed25519.PrivateKey:
+		alg = "EdDSA"
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+
+	id, err := keyID(private.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &signingKey{id: id, alg: alg, private: private}, nil
+}
+
+// generateSigningKey creates a new key for the given algorithm.
+func generateSigningKey(alg string) (*signingKey, error) {
+	switch alg {
+	case "RS256":
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(private)
+	case "EdDSA":
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(private)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+// loadSigningKey reads a PEM encoded PKCS #8 (RSA or Ed25519) or PKCS #1 (RSA)
+// private key.
+func loadSigningKey(path string) (*signingKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(private)
+	}
+
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, private)
+	}
+
+	return newSigningKey(signer)
+}
+
+// keyRing holds the key that signs new tokens and the older keys that may
+// still have signed unexpired tokens. Every key is published in the JWKS.
+type keyRing struct {
+	mu   sync.RWMutex
+	keys []*signingKey
+}
+
+// current returns the key that signs new tokens.
+func (k *keyRing) current() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.keys[0]
+}
+
+func (k *keyRing) lookup(id string) *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.id == id {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// rotate makes key the signing key at now. The previous keys stay published
+// until the tokens they signed have expired.
+func (k *keyRing) rotate(key *signingKey, tokenTTL time.Duration, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := []*signingKey{key}
+	for _, old := range k.keys {
+		if old.retiredAt.IsZero() {
+			old.retiredAt = now
+		}
+		if now.Sub(old.retiredAt) <= tokenTTL {
+			keys = append(keys, old)
+		}
+	}
+
+	k.keys = keys
+}
+
+// jwks returns the public keys in JSON Web Key Set format.
+func (k *keyRing) jwks() map[string]interface{} {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := []map[string]string{}
+	for _, key := range k.keys {
+		jwk := map[string]string{
+			"kid": key.id,
+			"alg": key.alg,
+			"use": "sig",
+		}
+
+		switch public := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		}
+
+		keys = append(keys, jwk)
+	}
+
+	return map[string]interface{}{"keys": keys}
+}
+
+// jwtKeys signs and verifies the tokens issued by this app. It is nil when
+// token issuance is disabled.
+var jwtKeys *keyRing
+
+// setupJWT loads the configured signing keys, or generates one that is
+// rotated every conf.JWTRotation.
+func setupJWT() {
+	jwtKeys = &keyRing{}
+
+	var files []string
+	for _, f := range strings.Split(conf.JWTKeyFiles, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, f)
+		}
+	}
+
+	// With key files, the first one signs and the others are only
+	// published, so rotating means adding a new file at the front.
+	if len(files) > 0 {
+		for _, f := range files {
+			key, err := loadSigningKey(f)
+			if err != nil {
+				log.Fatal("Error loading JWT key: ", err)
+			}
+			jwtKeys.keys = append(jwtKeys.keys, key)
+		}
+		return
+	}
+
+	key, err := generateSigningKey(conf.JWTAlgorithm)
+	if err != nil {
+		log.Fatal("Error generating JWT key: ", err)
+	}
+	jwtKeys.rotate(key, conf.JWTTTL, time.Now())
+
+	if conf.JWTRotation > 0 {
+		go func() {
+			for range time.Tick(conf.JWTRotation) {
+				key, err := generateSigningKey(conf.JWTAlgorithm)
+				if err != nil {
+					log.Printf("rotating JWT key failed: %s", err)
+					continue
+				}
+				jwtKeys.rotate(key, conf.JWTTTL, time.Now())
+				log.Printf("rotated JWT signing key to %s", key.id)
+			}
+		}()
+	}
+}
+
+// issueToken signs a token for the given profile claims.
+func issueToken(claims Claims) (string, error) {
+	key := jwtKeys.current()
+
+	now := time.Now()
+	claims.Issuer = conf.JWTIssuer
+	claims.Audience = conf.JWTAudience
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(conf.JWTTTL).Unix()
+
+	header, err := json.Marshal(map[string]string{"alg": key.alg, "typ": "JWT", "kid": key.id})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	signature, err := key.sign(signingInput)
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// sign signs the header and payload of a token with the key.
+func (key *signingKey) sign(signingInput string) ([]byte, error) {
+	switch key.alg {
+	case "RS256":
+		digest := sha256.Sum256([]byte(signingInput))
+		return key.private.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case "EdDSA":
+		return key.private.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", key.alg)
+	}
+}
+
+// verifyToken checks the signature, issuer, audience and validity period of
+// a token issued by this app and returns its claims.
+func verifyToken(token string) (Claims, error) {
+	var claims Claims
+
+	if jwtKeys == nil {
+		return claims, errTokenKey
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errTokenMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, errTokenMalformed
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errTokenMalformed
+	}
+
+	// The algorithm comes from our key, never from the token header.
+	key := jwtKeys.lookup(header.Kid)
+	if key == nil || key.alg != header.Alg {
+		return claims, errTokenKey
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	switch public := key.private.Public().(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		err = rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(public, []byte(signingInput), signature) {
+			err = errTokenSignature
+		}
+	}
+	if err != nil {
+		return claims, errTokenSignature
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, errTokenMalformed
+	}
+	if claims.Issuer != conf.JWTIssuer {
+		return claims, errTokenIssuer
+	}
+	if claims.Audience != conf.JWTAudience {
+		return claims, errTokenAudience
+	}
+
+	now := time.Now()
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, errTokenExpired
+	}
+	if latest := now.Add(tokenLeeway).Unix(); claims.IssuedAt > latest || claims.NotBefore > latest {
+		return claims, errTokenNotYet
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(jwtKeys.jwks())
+}
+
+type claimsKey struct{}
+
+// requestClaims returns the claims of the user authenticated by RequireAPIAuth.
+func requestClaims(r *http.Request) Claims {
+	claims, _ := r.Context().Value(claimsKey{}).(Claims)
+	return claims
+}
+
+// RequireAPIAuth lets through requests carrying either a valid bearer token
+// issued by this app or a signed in session cookie, and makes the user's
+// claims available through requestClaims.
+func RequireAPIAuth(next http.Handler) http.Handler {
+	withSession := RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "cookie-name")
+
+		claims, ok := sessionClaims(session)
+		if !ok {
+			writeUnauthorized(w)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			withSession.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := verifyToken(strings.TrimPrefix(authorization, "Bearer "))
+		if err != nil {
+			log.Printf("bearer token rejected: %s", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeUnauthorized(w)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+// me describes the signed in user.
+func me(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requestClaims(r))
+}
+
+// apiToken issues a fresh token to the user signed in with a session cookie.
+func apiToken(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "cookie-name")
+
+	claims, ok := sessionClaims(session)
+	if !ok {
+		writeUnauthorized(w)
+		return
+	}
+
+	token, err := issueToken(claims)
+	if err != nil {
+		log.Printf("issuing token failed: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(conf.JWTTTL.Seconds()),
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+var testRSAKey, testEdDSAKey = func() (*signingKey, *signingKey) {
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	rsaKey, err := newSigningKey(rsaPrivate)
+	if err != nil {
+		panic(err)
+	}
+
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	edKey, err := newSigningKey(edPrivate)
+	if err != nil {
+		panic(err)
+	}
+
+	return rsaKey, edKey
+}()
+
+// useKeys makes the keys the ones tokens are signed and verified with for
+// the rest of the test, the first one signing.
+func useKeys(t *testing.T, keys ...*signingKey) {
+	saved, issuer, audience := jwtKeys, conf.JWTIssuer, conf.JWTAudience
+	t.Cleanup(func() {
+		jwtKeys, conf.JWTIssuer, conf.JWTAudience = saved, issuer, audience
+	})
+
+	jwtKeys = &keyRing{keys: keys}
+	conf.JWTIssuer = "https://sso.example.com"
+	conf.JWTAudience = "reports"
+}
+
+// validClaims returns the claims of a token that is valid now.
+func validClaims() Claims {
+	now := time.Now()
+	return Claims{
+		Issuer:    conf.JWTIssuer,
+		Subject:   "1",
+		Audience:  conf.JWTAudience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		Email:     "ada@example.com",
+	}
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signTestToken signs the claims with the key, using the alg and kid given
+// in the header rather than those of the key.
+func signTestToken(t *testing.T, key *signingKey, alg, kid string, claims Claims) string {
+	signingInput := encodeSegment(t, map[string]string{"alg": alg, "typ": "JWT", "kid": kid}) + "." + encodeSegment(t, claims)
+
+	signature, err := key.sign(signingInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyToken(t *testing.T) {
+	useKeys(t, testRSAKey, testEdDSAKey)
+
+	withClaims := func(change func(*Claims)) func(*testing.T) string {
+		return func(t *testing.T) string {
+			claims := validClaims()
+			change(&claims)
+			return signTestToken(t, testRSAKey, "RS256", testRSAKey.id, claims)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token func(*testing.T) string
+		err   error
+	}{
+		{"RS256", func(t *testing.T) string {
+			return signTestToken(t, testRSAKey, "RS256", testRSAKey.id, validClaims())
+		}, nil},
+		{"EdDSA", func(t *testing.T) string {
+			return signTestToken(t, testEdDSAKey, "EdDSA", testEdDSAKey.id, validClaims())
+		}, nil},
+		{"malformed", func(t *testing.T) string {
+			return "not.a-token"
+		}, errTokenMalformed},
+		{"unknown kid", func(t *testing.T) string {
+			return signTestToken(t, testRSAKey, "RS256", "unknown", validClaims())
+		}, errTokenKey},
+		{"alg and kid mismatch", func(t *testing.T) string {
+			return signTestToken(t, testRSAKey, "RS256", testEdDSAKey.id, validClaims())
+		}, errTokenKey},
+		{"alg not matching the key type", func(t *testing.T) string {
+			return signTestToken(t, testEdDSAKey, "EdDSA", testRSAKey.id, validClaims())
+		}, errTokenKey},
+		{"signed by another key", func(t *testing.T) string {
+			return signTestToken(t, testEdDSAKey, "RS256", testRSAKey.id, validClaims())
+		}, errTokenSignature},
+		{"alg none", func(t *testing.T) string {
+			return encodeSegment(t, map[string]string{"alg": "none", "kid": testRSAKey.id}) + "." + encodeSegment(t, validClaims()) + "."
+		}, errTokenKey},
+		{"alg HS256", func(t *testing.T) string {
+			return signTestToken(t, testRSAKey, "HS256", testRSAKey.id, validClaims())
+		}, errTokenKey},
+		{"tampered payload", func(t *testing.T) string {
+			token := signTestToken(t, testRSAKey, "RS256", testRSAKey.id, validClaims())
+			parts := strings.Split(token, ".")
+			claims := validClaims()
+			claims.Email = "mallory@example.com"
+			return parts[0] + "." + encodeSegment(t, claims) + "." + parts[2]
+		}, errTokenSignature},
+		{"tampered signature", func(t *testing.T) string {
+			token := signTestToken(t, testRSAKey, "RS256", testRSAKey.id, validClaims())
+			parts := strings.Split(token, ".")
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			signature[0] ^= 0xff
+			return parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature)
+		}, errTokenSignature},
+		{"wrong issuer", withClaims(func(c *Claims) { c.Issuer = "https://evil.example.com" }), errTokenIssuer},
+		{"wrong audience", withClaims(func(c *Claims) { c.Audience = "billing" }), errTokenAudience},
+		{"no audience", withClaims(func(c *Claims) { c.Audience = "" }), errTokenAudience},
+		{"expired", withClaims(func(c *Claims) { c.ExpiresAt = time.Now().Add(-time.Second).Unix() }), errTokenExpired},
+		{"not before in the future", withClaims(func(c *Claims) { c.NotBefore = time.Now().Add(time.Hour).Unix() }), errTokenNotYet},
+		{"not before within the leeway", withClaims(func(c *Claims) { c.NotBefore = time.Now().Add(tokenLeeway / 2).Unix() }), nil},
+		{"issued in the future", withClaims(func(c *Claims) { c.IssuedAt = time.Now().Add(time.Hour).Unix() }), errTokenNotYet},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := verifyToken(test.token(t))
+			if err != test.err {
+				t.Fatalf("verifyToken returned %v, want %v", err, test.err)
+			}
+			if err == nil && claims.Email != "ada@example.com" {
+				t.Errorf("verifyToken returned email %q, want %q", claims.Email, "ada@example.com")
+			}
+		})
+	}
+}
+
+func TestIssueToken(t *testing.T) {
+	useKeys(t, testEdDSAKey)
+
+	profile := sso.Profile{ID: "prof_1", Email: "ada@example.com", FirstName: "Ada", LastName: "Lovelace"}
+	token, err := issueToken(profileClaims(42, profile, []string{"admin"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := verifyToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "42" {
+		t.Errorf("sub is %q, want the user ID 42", claims.Subject)
+	}
+	if claims.Issuer != conf.JWTIssuer || claims.Audience != conf.JWTAudience {
+		t.Errorf("iss and aud are %q and %q, want %q and %q", claims.Issuer, claims.Audience, conf.JWTIssuer, conf.JWTAudience)
+	}
+	if ttl := time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second; ttl != conf.JWTTTL {
+		t.Errorf("token is valid for %s, want %s", ttl, conf.JWTTTL)
+	}
+}
+
+// newTestKeys generates n EdDSA keys, which are quick to generate.
+func newTestKeys(t *testing.T, n int) []*signingKey {
+	keys := make([]*signingKey, n)
+	for i := range keys {
+		key, err := generateSigningKey("EdDSA")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+
+	return keys
+}
+
+func TestKeyRotation(t *testing.T) {
+	useKeys(t)
+
+	ttl := time.Hour
+	start := time.Now()
+	keys := newTestKeys(t, 4)
+
+	jwtKeys.rotate(keys[0], ttl, start)
+	token, err := issueToken(validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key keeps verifying the tokens it signed while they may
+	// still be valid.
+	jwtKeys.rotate(keys[1], ttl, start.Add(time.Minute))
+	if current := jwtKeys.current(); current != keys[1] {
+		t.Fatalf("the current key is %s, want the new key %s", current.id, keys[1].id)
+	}
+	if _, err := verifyToken(token); err != nil {
+		t.Fatalf("token of the rotated out key within the TTL: %v", err)
+	}
+
+	jwtKeys.rotate(keys[2], ttl, start.Add(time.Minute+ttl))
+	if _, err := verifyToken(token); err != nil {
+		t.Fatalf("token of the rotated out key at the end of the TTL: %v", err)
+	}
+
+	// Once they can't be, it is dropped.
+	jwtKeys.rotate(keys[3], ttl, start.Add(time.Minute+ttl+time.Second))
+	if _, err := verifyToken(token); err != errTokenKey {
+		t.Fatalf("token of the rotated out key after the TTL returned %v, want %v", err, errTokenKey)
+	}
+	if jwtKeys.lookup(keys[1].id) == nil || jwtKeys.lookup(keys[2].id) == nil {
+		t.Error("keys retired within the TTL were dropped too")
+	}
+}
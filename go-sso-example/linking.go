@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// LinkRules decide which users signing in with the same email may be linked
+// into one account.
+type LinkRules struct {
+	// AutoLink lists the connection types that are linked without asking
+	// when both users have one of them and belong to the same organization.
+	AutoLink []string `json:"auto_link"`
+
+	// Never lists the connection types that are never linked.
+	Never []string `json:"never"`
+}
+
+// linkRules are loaded from conf.LinkRulesFile at startup. By default every
+// link has to be confirmed.
+var linkRules LinkRules
+
+func loadLinkRules(path string) (LinkRules, error) {
+	if path == "" {
+		return linkRules, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return LinkRules{}, err
+	}
+
+	var rules LinkRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return LinkRules{}, err
+	}
+
+	return rules, nil
+}
+
+func (rules LinkRules) allowed(connectionType string) bool {
+	for _, t := range rules.Never {
+		if t == connectionType {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (rules LinkRules) automatic(connectionType string) bool {
+	for _, t := range rules.AutoLink {
+		if t == connectionType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LinkPage is rendered by static/link_account.html.
+type LinkPage struct {
+	Identity  User
+	Candidate User
+
+	Impersonation *Impersonation
+}
+
+// AccountPage is rendered by static/account.html.
+type AccountPage struct {
+	User       User
+	Identities []User
+	IdentityID int64
+
+	Impersonation *Impersonation
+}
+
+// sameOrganization reports whether two users with the same email belong to
+// the same organization: either both report it, or the email domain is
+// verified for the organization one of them reports. Users without an
+// organization never do.
+func sameOrganization(ctx context.Context, a, b User) bool {
+	if a.OrganizationID != "" && a.OrganizationID == b.OrganizationID {
+		return true
+	}
+	if a.OrganizationID != "" && b.OrganizationID != "" {
+		return false
+	}
+
+	// Users who both lack an organization don't share one, whatever their
+	// email domain.
+	org := a.OrganizationID + b.OrganizationID
+	if org == "" {
+		return false
+	}
+
+	domain, ok := emailDomain(a.Email)
+	if !ok {
+		return false
+	}
+
+	tenant, found, err := lookupTenant(ctx, domain)
+	if err != nil {
+		log.Printf("organization lookup for %s failed: %s", domain, err)
+	}
+
+	return found && tenant.Organization == org
+}
+
+// linkCandidate returns the user with the same email that the user who just
+// signed in may be linked to.
+func linkCandidate(identity User) (User, bool, error) {
+	if identity.LinkedTo != 0 || !linkRules.allowed(identity.ConnectionType) {
+		return User{}, false, nil
+	}
+	if _, ok := emailDomain(identity.Email); !ok {
+		return User{}, false, nil
+	}
+
+	list, err := users.FindByEmail(identity.Email)
+	if err != nil {
+		return User{}, false, err
+	}
+
+	for _, candidate := range list {
+		if candidate.ID == identity.ID || !linkRules.allowed(candidate.ConnectionType) {
+			continue
+		}
+
+		// Users of two different organizations are different people.
+		if candidate.OrganizationID != "" && identity.OrganizationID != "" &&
+			candidate.OrganizationID != identity.OrganizationID {
+			continue
+		}
+
+		return candidate, true, nil
+	}
+
+	return User{}, false, nil
+}
+
+// linkUsers links identity to the user it and records why.
+func linkUsers(r *http.Request, identity, to User, reason string) error {
+	if err := users.Link(identity.ID, to.ID); err != nil {
+		return err
+	}
+
+	log.Printf("linked user %d to user %d (%s)", identity.ID, to.ID, reason)
+
+	err := writeAudit(AuditEvent{
+		Event:  "account.linked",
+		Actor:  userIdentity(identity),
+		Target: userIdentity(to),
+		IP:     clientIP(r),
+		Reason: reason,
+	})
+	if err != nil {
+		log.Printf("writing audit log failed: %s", err)
+	}
+
+	return nil
+}
+
+func userIdentity(user User) AuditIdentity {
+	return AuditIdentity{
+		UserID: user.ID,
+		Email:  user.Email,
+		Name:   strings.TrimSpace(user.FirstName + " " + user.LastName),
+	}
+}
+
+// linkSignedInUser returns the user that signing in as identity signs in as.
+// Users that may be linked without asking are linked first. Otherwise the
+// user they may be linked to is returned as the candidate, for the user to
+// confirm.
+func linkSignedInUser(r *http.Request, identity User) (user, candidate User, offer bool, err error) {
+	if identity.LinkedTo != 0 {
+		user, err = resolveUser(identity)
+		return user, User{}, false, err
+	}
+
+	candidate, found, err := linkCandidate(identity)
+	if err != nil || !found {
+		return identity, User{}, false, err
+	}
+
+	if linkRules.automatic(identity.ConnectionType) && linkRules.automatic(candidate.ConnectionType) &&
+		sameOrganization(r.Context(), identity, candidate) {
+		if err := linkUsers(r, identity, candidate, "automatic"); err != nil {
+			return User{}, User{}, false, err
+		}
+		return candidate, User{}, false, nil
+	}
+
+	return identity, candidate, true, nil
+}
+
+// completePendingLink links the user that asked to be linked, once its owner
+// has proven they can also sign in as the user it is linked to. It reports
+// whether the users were linked.
+func completePendingLink(r *http.Request, session *sessions.Session, identity User) bool {
+	pendingID, ok := session.Values["link_pending"].(int64)
+	targetID, _ := session.Values["link_target"].(int64)
+	delete(session.Values, "link_pending")
+	delete(session.Values, "link_target")
+	if !ok {
+		return false
+	}
+
+	signedIn, err := resolveUser(identity)
+	if err != nil {
+		log.Printf("linking user %d failed: %s", pendingID, err)
+		return false
+	}
+	if signedIn.ID != targetID {
+		log.Printf("not linking user %d: signed in as user %d instead of %d", pendingID, signedIn.ID, targetID)
+		return false
+	}
+
+	pending, err := users.Get(pendingID)
+	if err == nil && !strings.EqualFold(pending.Email, signedIn.Email) {
+		return false
+	}
+	if err == nil {
+		err = linkUsers(r, pending, signedIn, "confirmed")
+	}
+	if err != nil {
+		log.Printf("linking user %d failed: %s", pendingID, err)
+		return false
+	}
+
+	return true
+}
+
+// sessionUserIDs returns the ID of the user signed in with the session, and
+// of the linked user they signed in as.
+func sessionUserIDs(session *sessions.Session) (userID, identityID int64) {
+	userID, _ = session.Values["user_id"].(int64)
+	identityID, _ = session.Values["identity_id"].(int64)
+	if identityID == 0 {
+		identityID = userID
+	}
+
+	return userID, identityID
+}
+
+// linkAccount offers to link the user who just signed in to the existing
+// user with the same email. Linking starts a login as the existing user,
+// which proves the user owns both.
+func linkAccount(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "cookie-name")
+	_, identityID := sessionUserIDs(session)
+
+	candidateID, ok := session.Values["link_offer"].(int64)
+	if !ok || sessionImpersonation(session) != nil {
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	identity, err := users.Get(identityID)
+	if err != nil {
+		log.Panic(err)
+	}
+	candidate, err := users.Get(candidateID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if r.Method != http.MethodPost {
+		tmpl := template.Must(template.ParseFiles("./static/link_account.html", "./static/impersonation_banner.html"))
+		if err := tmpl.Execute(w, LinkPage{identity, candidate, sessionImpersonation(session)}); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+
+	delete(session.Values, "link_offer")
+
+	if r.FormValue("action") != "link" {
+		if err := session.Save(r, w); err != nil {
+			log.Panic(err)
+		}
+		http.Redirect(w, r, "/logged_in", http.StatusSeeOther)
+		return
+	}
+
+	session.Values["link_pending"] = identity.ID
+	session.Values["link_target"] = candidate.ID
+
+	startLogin(w, r, sso.GetAuthorizationURLOpts{
+		Connection: candidate.ConnectionID,
+		LoginHint:  candidate.Email,
+	})
+}
+
+// account lists the users linked into the signed in user's account.
+func account(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "cookie-name")
+	userID, identityID := sessionUserIDs(session)
+
+	user, err := users.Get(userID)
+	if err != nil {
+		log.Panic(err)
+	}
+	linked, err := users.Linked(userID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	page := AccountPage{
+		User:       user,
+		Identities: append([]User{user}, linked...),
+		IdentityID: identityID,
+
+		Impersonation: sessionImpersonation(session),
+	}
+
+	tmpl := template.Must(template.ParseFiles("./static/account.html", "./static/impersonation_banner.html"))
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Panic(err)
+	}
+}
+
+// unlinkAccount unlinks one of the users linked into the signed in user's
+// account, other than the one they signed in as.
+func unlinkAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	userID, identityID := sessionUserIDs(session)
+
+	if sessionImpersonation(session) != nil {
+		renderError(w, http.StatusForbidden, "Accounts can't be unlinked while impersonating",
+			"Stop impersonating the user first.")
+		return
+	}
+
+	id, _ := strconv.ParseInt(r.FormValue("identity"), 10, 64)
+	if id == identityID {
+		renderError(w, http.StatusBadRequest, "You are signed in with this login",
+			"Sign in another way to unlink it.")
+		return
+	}
+
+	identity, err := users.Get(id)
+	if err != nil || identity.LinkedTo != userID {
+		renderError(w, http.StatusNotFound, "Login not found",
+			"This login is not linked to your account.")
+		return
+	}
+
+	if err := users.Link(id, 0); err != nil {
+		log.Panic(err)
+	}
+
+	log.Printf("unlinked user %d from user %d", id, userID)
+
+	user, _ := users.Get(userID)
+	err = writeAudit(AuditEvent{
+		Event:  "account.unlinked",
+		Actor:  userIdentity(user),
+		Target: userIdentity(identity),
+		IP:     clientIP(r),
+	})
+	if err != nil {
+		log.Printf("writing audit log failed: %s", err)
+	}
+
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// useLinking gives the rest of the test its own users, link rules and
+// tenants.
+func useLinking(t *testing.T, rules LinkRules, domains map[string]Tenant) {
+	savedUsers, savedRules, savedTenants := users, linkRules, tenants
+	t.Cleanup(func() {
+		users, linkRules, tenants = savedUsers, savedRules, savedTenants
+	})
+
+	users = newMemoryUserRepository()
+	linkRules = rules
+	tenants = domains
+}
+
+// provisionTestUser signs the profile in for the first time.
+func provisionTestUser(t *testing.T, id, connectionType, org, email string) User {
+	user, err := users.Upsert(sso.Profile{
+		ID:             id,
+		ConnectionID:   "conn_" + id,
+		ConnectionType: sso.ConnectionType(connectionType),
+		OrganizationID: org,
+		Email:          email,
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func TestSameOrganization(t *testing.T) {
+	useLinking(t, LinkRules{}, map[string]Tenant{"example.com": {Organization: "org_example"}})
+
+	tests := []struct {
+		name       string
+		orgA, orgB string
+		email      string
+		same       bool
+	}{
+		{"same organization", "org_example", "org_example", "ada@other.test", true},
+		{"different organizations", "org_example", "org_globex", "ada@example.com", false},
+		{"neither has an organization", "", "", "ada@example.com", false},
+		{"domain verified for the organization", "org_example", "", "ada@example.com", true},
+		{"domain verified for the other organization", "", "org_example", "ada@example.com", true},
+		{"domain verified for another organization", "org_globex", "", "ada@example.com", false},
+		{"domain not verified", "org_example", "", "ada@other.test", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := User{OrganizationID: test.orgA, Email: test.email}
+			b := User{OrganizationID: test.orgB, Email: test.email}
+			if same := sameOrganization(context.Background(), a, b); same != test.same {
+				t.Errorf("sameOrganization returned %t, want %t", same, test.same)
+			}
+		})
+	}
+}
+
+func TestLinkCandidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    LinkRules
+		existing User
+		identity User
+		found    bool
+	}{
+		{
+			name:     "same email",
+			existing: User{ConnectionType: string(sso.OktaSAML), Email: "ada@example.com"},
+			identity: User{ConnectionType: string(sso.GoogleOAuth), Email: "Ada@Example.com"},
+			found:    true,
+		},
+		{
+			name:     "same organization",
+			existing: User{ConnectionType: string(sso.OktaSAML), OrganizationID: "org_example", Email: "ada@example.com"},
+			identity: User{ConnectionType: string(sso.GoogleOAuth), OrganizationID: "org_example", Email: "ada@example.com"},
+			found:    true,
+		},
+		{
+			name:     "different organizations",
+			existing: User{ConnectionType: string(sso.OktaSAML), OrganizationID: "org_example", Email: "ada@example.com"},
+			identity: User{ConnectionType: string(sso.GenericOIDC), OrganizationID: "org_globex", Email: "ada@example.com"},
+		},
+		{
+			name:     "different email",
+			existing: User{ConnectionType: string(sso.OktaSAML), Email: "ada@example.com"},
+			identity: User{ConnectionType: string(sso.GoogleOAuth), Email: "grace@example.com"},
+		},
+		{
+			name:     "never linked",
+			rules:    LinkRules{Never: []string{string(sso.GoogleOAuth)}},
+			existing: User{ConnectionType: string(sso.OktaSAML), Email: "ada@example.com"},
+			identity: User{ConnectionType: string(sso.GoogleOAuth), Email: "ada@example.com"},
+		},
+		{
+			name:     "never linked to",
+			rules:    LinkRules{Never: []string{string(sso.OktaSAML)}},
+			existing: User{ConnectionType: string(sso.OktaSAML), Email: "ada@example.com"},
+			identity: User{ConnectionType: string(sso.GoogleOAuth), Email: "ada@example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useLinking(t, test.rules, map[string]Tenant{})
+
+			existing := provisionTestUser(t, "prof_existing", test.existing.ConnectionType, test.existing.OrganizationID, test.existing.Email)
+			identity := provisionTestUser(t, "prof_identity", test.identity.ConnectionType, test.identity.OrganizationID, test.identity.Email)
+
+			candidate, found, err := linkCandidate(identity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != test.found {
+				t.Fatalf("linkCandidate found a candidate: %t, want %t", found, test.found)
+			}
+			if found && candidate.ID != existing.ID {
+				t.Errorf("linkCandidate returned user %d, want %d", candidate.ID, existing.ID)
+			}
+		})
+	}
+}
+
+func TestLinkSignedInUser(t *testing.T) {
+	automatic := LinkRules{AutoLink: []string{string(sso.OktaSAML), string(sso.GoogleOAuth)}}
+	r := httptest.NewRequest("GET", "/callback", nil)
+
+	t.Run("same organization", func(t *testing.T) {
+		useLinking(t, automatic, map[string]Tenant{"example.com": {Organization: "org_example"}})
+		existing := provisionTestUser(t, "prof_saml", string(sso.OktaSAML), "org_example", "ada@example.com")
+		identity := provisionTestUser(t, "prof_google", string(sso.GoogleOAuth), "", "ada@example.com")
+
+		user, _, offer, err := linkSignedInUser(r, identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offer || user.ID != existing.ID {
+			t.Fatalf("signed in as user %d with an offer %t, want user %d linked without asking", user.ID, offer, existing.ID)
+		}
+		if linked, _ := users.Linked(existing.ID); len(linked) != 1 || linked[0].ID != identity.ID {
+			t.Errorf("users linked to %d are %v, want %d", existing.ID, linked, identity.ID)
+		}
+	})
+
+	t.Run("neither has an organization", func(t *testing.T) {
+		useLinking(t, automatic, map[string]Tenant{"example.com": {Organization: "org_example"}})
+		existing := provisionTestUser(t, "prof_saml", string(sso.OktaSAML), "", "ada@example.com")
+		identity := provisionTestUser(t, "prof_google", string(sso.GoogleOAuth), "", "ada@example.com")
+
+		// Nothing proves they are the same person, so the user is asked.
+		user, candidate, offer, err := linkSignedInUser(r, identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !offer || user.ID != identity.ID || candidate.ID != existing.ID {
+			t.Fatalf("signed in as user %d with an offer %t for %d, want user %d offered %d", user.ID, offer, candidate.ID, identity.ID, existing.ID)
+		}
+		if linked, _ := users.Linked(existing.ID); len(linked) != 0 {
+			t.Errorf("users were linked without asking: %v", linked)
+		}
+	})
+
+	t.Run("different organizations", func(t *testing.T) {
+		useLinking(t, automatic, map[string]Tenant{})
+		provisionTestUser(t, "prof_saml", string(sso.OktaSAML), "org_example", "ada@example.com")
+		identity := provisionTestUser(t, "prof_google", string(sso.GoogleOAuth), "org_globex", "ada@example.com")
+
+		user, _, offer, err := linkSignedInUser(r, identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offer || user.ID != identity.ID {
+			t.Errorf("signed in as user %d with an offer %t, want user %d without one", user.ID, offer, identity.ID)
+		}
+	})
+}
+
+// newLinkSession returns a session of the user that asked to link pending to
+// target.
+func newLinkSession(pending, target User) *sessions.Session {
+	session := sessions.NewSession(store, "cookie-name")
+	session.Values["link_pending"] = pending.ID
+	session.Values["link_target"] = target.ID
+	return session
+}
+
+func TestCompletePendingLink(t *testing.T) {
+	r := httptest.NewRequest("GET", "/callback", nil)
+
+	t.Run("signed in as the target", func(t *testing.T) {
+		useLinking(t, LinkRules{}, map[string]Tenant{})
+		target := provisionTestUser(t, "prof_saml", string(sso.OktaSAML), "", "ada@example.com")
+		pending := provisionTestUser(t, "prof_google", string(sso.GoogleOAuth), "", "ada@example.com")
+
+		session := newLinkSession(pending, target)
+		if !completePendingLink(r, session, target) {
+			t.Fatal("the users were not linked")
+		}
+		if linked, _ := users.Linked(target.ID); len(linked) != 1 || linked[0].ID != pending.ID {
+			t.Errorf("users linked to %d are %v, want %d", target.ID, linked, pending.ID)
+		}
+		if _, ok := session.Values["link_pending"]; ok {
+			t.Error("the pending link was kept in the session")
+		}
+	})
+
+	t.Run("signed in as another user", func(t *testing.T) {
+		useLinking(t, LinkRules{}, map[string]Tenant{})
+		target := provisionTestUser(t, "prof_saml", string(sso.OktaSAML), "", "ada@example.com")
+		pending := provisionTestUser(t, "prof_google", string(sso.GoogleOAuth), "", "ada@example.com")
+		other := provisionTestUser(t, "prof_other", string(sso.OktaSAML), "", "ada@example.com")
+
+		if completePendingLink(r, newLinkSession(pending, target), other) {
+			t.Error("the users were linked after signing in as another user")
+		}
+	})
+
+	t.Run("email changed", func(t *testing.T) {
+		useLinking(t, LinkRules{}, map[string]Tenant{})
+		target := provisionTestUser(t, "prof_saml", string(sso.OktaSAML), "", "ada@example.com")
+		pending := provisionTestUser(t, "prof_google", string(sso.GoogleOAuth), "", "ada@example.com")
+		target = provisionTestUser(t, "prof_saml", string(sso.OktaSAML), "", "mallory@example.com")
+
+		if completePendingLink(r, newLinkSession(pending, target), target) {
+			t.Error("users with different emails were linked")
+		}
+	})
+
+	t.Run("nothing pending", func(t *testing.T) {
+		useLinking(t, LinkRules{}, map[string]Tenant{})
+		target := provisionTestUser(t, "prof_saml", string(sso.OktaSAML), "", "ada@example.com")
+
+		if completePendingLink(r, sessions.NewSession(store, "cookie-name"), target) {
+			t.Error("completePendingLink linked users without a pending link")
+		}
+	})
+}
+
+func TestUnlinkAccount(t *testing.T) {
+	useLinking(t, LinkRules{}, map[string]Tenant{})
+	user := provisionTestUser(t, "prof_saml", string(sso.OktaSAML), "", "ada@example.com")
+	linked := provisionTestUser(t, "prof_google", string(sso.GoogleOAuth), "", "ada@example.com")
+	if err := users.Link(linked.ID, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	session := sessions.NewSession(store, "cookie-name")
+	opts := *store.options
+	session.Options = &opts
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = user.ID
+	cookie := saveTestSession(t, store, session)
+
+	unlink := func(id int64) int {
+		r := httptest.NewRequest("POST", "/account/unlink", strings.NewReader(url.Values{
+			"identity": {strconv.FormatInt(id, 10)},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		unlinkAccount(w, r)
+		return w.Code
+	}
+
+	// The login the user signed in with can't be unlinked.
+	if status := unlink(user.ID); status != http.StatusBadRequest {
+		t.Errorf("unlinking the login signed in with returned %d, want %d", status, http.StatusBadRequest)
+	}
+
+	if status := unlink(linked.ID); status != http.StatusSeeOther {
+		t.Fatalf("unlinking returned %d, want %d", status, http.StatusSeeOther)
+	}
+	if list, _ := users.Linked(user.ID); len(list) != 0 {
+		t.Errorf("users still linked after unlinking: %v", list)
+	}
+	if got, _ := users.Get(linked.ID); got.LinkedTo != 0 {
+		t.Errorf("unlinked user is linked to %d", got.LinkedTo)
+	}
+
+	// Once unlinked, it isn't part of the account anymore.
+	if status := unlink(linked.ID); status != http.StatusNotFound {
+		t.Errorf("unlinking again returned %d, want %d", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// The outcomes of a login attempt.
+const (
+	loginStarted   = "started"
+	loginSucceeded = "succeeded"
+	loginFailed    = "failed"
+)
+
+// LoginEvent records a login attempt.
+type LoginEvent struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+
+	// Connection, Provider and Organization are what the login was started
+	// with, or what the profile reported once signed in.
+	Connection   string `json:"connection,omitempty"`
+	Provider     string `json:"provider,omitempty"`
+	Organization string `json:"organization,omitempty"`
+
+	UserID    int64  `json:"user_id,omitempty"`
+	ProfileID string `json:"profile_id,omitempty"`
+	Email     string `json:"email,omitempty"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+
+	// Error is the reason a login failed.
+	Error string `json:"error,omitempty"`
+}
+
+func init() {
+	gob.Register(LoginEvent{})
+}
+
+// LoginQuery selects login events. Zero fields match every event.
+type LoginQuery struct {
+	// Text matches events whose email, profile, connection, provider,
+	// organization, IP address or error contains it.
+	Text    string
+	Outcome string
+	UserID  int64
+	Since   time.Time
+	Until   time.Time
+
+	Limit  int
+	Offset int
+}
+
+// LoginHistory is an append-only store of login events.
+type LoginHistory interface {
+	// Append records the event under a new ID.
+	Append(event LoginEvent) error
+
+	// Search returns the events matching the query, most recent first, and
+	// how many match in total, regardless of Limit and Offset.
+	Search(query LoginQuery) ([]LoginEvent, int, error)
+}
+
+// newLoginHistory returns the store selected by name. path is the database
+// used by the sqlite store.
+func newLoginHistory(name, path string) (LoginHistory, error) {
+	switch name {
+	case "memory":
+		return &memoryLoginHistory{}, nil
+	case "sqlite":
+		return newSQLiteLoginHistory(path)
+	default:
+		return nil, fmt.Errorf("unknown login history store %q", name)
+	}
+}
+
+// loginHistory records every login attempt.
+var loginHistory LoginHistory
+
+// loginAttempt returns the event for the login started in the session.
+func loginAttempt(session *sessions.Session) LoginEvent {
+	event, _ := session.Values["login_attempt"].(LoginEvent)
+	return event
+}
+
+// startLoginAttempt records a login being started with the options and saves
+// it in the session for the callback. The session must be saved by the
+// caller.
+func startLoginAttempt(r *http.Request, session *sessions.Session, opts sso.GetAuthorizationURLOpts) {
+	event := LoginEvent{
+		Connection:   opts.Connection,
+		Provider:     string(opts.Provider),
+		Organization: opts.Organization,
+		Email:        opts.LoginHint,
+	}
+
+	session.Values["login_attempt"] = event
+	recordLogin(r, event, loginStarted, "")
+}
+
+// recordLogin appends the attempt to the login history with the outcome.
+func recordLogin(r *http.Request, event LoginEvent, outcome, reason string) {
+	event.Time = time.Now().UTC().Truncate(time.Second)
+	event.Outcome = outcome
+	event.Error = reason
+	event.IP = clientIP(r)
+	event.UserAgent = r.UserAgent()
+
+	if err := loginHistory.Append(event); err != nil {
+		log.Printf("recording login failed: %s", err)
+	}
+}
+
+// recordLoginSuccess records a login that signed in as the user.
+func recordLoginSuccess(r *http.Request, event LoginEvent, profile sso.Profile, user User) {
+	event.Connection = profile.ConnectionID
+	event.Provider = string(profile.ConnectionType)
+	event.Organization = profile.OrganizationID
+	event.UserID = user.ID
+	event.ProfileID = profile.ID
+	event.Email = profile.Email
+
+	recordLogin(r, event, loginSucceeded, "")
+}
+
+func (e LoginEvent) matches(q LoginQuery) bool {
+	if q.Outcome != "" && e.Outcome != q.Outcome {
+		return false
+	}
+	if q.UserID != 0 && e.UserID != q.UserID {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+
+	if q.Text != "" {
+		text := strings.ToLower(q.Text)
+		for _, field := range []string{e.Email, e.ProfileID, e.Connection, e.Provider, e.Organization, e.IP, e.Error} {
+			if strings.Contains(strings.ToLower(field), text) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// memoryLoginHistory keeps login events in memory. They are lost on restart.
+type memoryLoginHistory struct {
+	mu     sync.Mutex
+	events []LoginEvent
+}
+
+func (m *memoryLoginHistory) Append(event LoginEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event.ID = int64(len(m.events) + 1)
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *memoryLoginHistory) Search(q LoginQuery) ([]LoginEvent, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matched []LoginEvent
+	for i := len(m.events) - 1; i >= 0; i-- {
+		if m.events[i].matches(q) {
+			matched = append(matched, m.events[i])
+		}
+	}
+
+	total := len(matched)
+	if q.Offset > len(matched) {
+		q.Offset = len(matched)
+	}
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+
+	return matched, total, nil
+}
+
+// sqliteLoginHistory keeps login events in a SQLite database. Triggers
+// reject any change to recorded events.
+type sqliteLoginHistory struct {
+	db *sql.DB
+}
+
+func newSQLiteLoginHistory(path string) (*sqliteLoginHistory, error) {
+	if path == "" {
+		path = "login_history.db"
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS login_events (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			time         INTEGER NOT NULL,
+			outcome      TEXT NOT NULL,
+			connection   TEXT NOT NULL,
+			provider     TEXT NOT NULL,
+			organization TEXT NOT NULL,
+			user_id      INTEGER NOT NULL,
+			profile_id   TEXT NOT NULL,
+			email        TEXT NOT NULL,
+			ip           TEXT NOT NULL,
+			user_agent   TEXT NOT NULL,
+			error        TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS login_events_time ON login_events (time)`,
+		`CREATE TRIGGER IF NOT EXISTS login_events_no_update BEFORE UPDATE ON login_events
+		BEGIN SELECT RAISE(ABORT, 'login events are append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS login_events_no_delete BEFORE DELETE ON login_events
+		BEGIN SELECT RAISE(ABORT, 'login events are append-only'); END`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &sqliteLoginHistory{db: db}, nil
+}
+
+func (s *sqliteLoginHistory) Append(event LoginEvent) error {
+	_, err := s.db.Exec(
+		`INSERT INTO login_events (
+			time, outcome, connection, provider, organization,
+			user_id, profile_id, email, ip, user_agent, error
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.Time.Unix(), event.Outcome, event.Connection, event.Provider, event.Organization,
+		event.UserID, event.ProfileID, event.Email, event.IP, event.UserAgent, event.Error,
+	)
+	return err
+}
+
+func (s *sqliteLoginHistory) Search(q LoginQuery) ([]LoginEvent, int, error) {
+	var where []string
+	var args []interface{}
+
+	if q.Outcome != "" {
+		where = append(where, "outcome = ?")
+		args = append(args, q.Outcome)
+	}
+	if q.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, q.UserID)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, q.Since.Unix())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, q.Until.Unix())
+	}
+	if q.Text != "" {
+		like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q.Text) + "%"
+		var fields []string
+		for _, column := range []string{"email", "profile_id", "connection", "provider", "organization", "ip", "error"} {
+			fields = append(fields, column+` LIKE ? ESCAPE '\'`)
+			args = append(args, like)
+		}
+		where = append(where, "("+strings.Join(fields, " OR ")+")")
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM login_events`+filter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := s.db.Query(
+		`SELECT id, time, outcome, connection, provider, organization,
+			user_id, profile_id, email, ip, user_agent, error
+		FROM login_events`+filter+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, q.Offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var events []LoginEvent
+	for rows.Next() {
+		var e LoginEvent
+		var at int64
+		err := rows.Scan(
+			&e.ID, &at, &e.Outcome, &e.Connection, &e.Provider, &e.Organization,
+			&e.UserID, &e.ProfileID, &e.Email, &e.IP, &e.UserAgent, &e.Error,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		e.Time = time.Unix(at, 0).UTC()
+		events = append(events, e)
+	}
+
+	return events, total, rows.Err()
+}
+
+// loginHistoryPageSize is how many events a page of the login history shows.
+const loginHistoryPageSize = 50
+
+// LoginHistoryPage is rendered by static/login_history.html.
+type LoginHistoryPage struct {
+	Query  url.Values
+	Events []LoginEvent
+	Total  int
+	Page   int
+	Pages  int
+
+	PrevURL string
+	NextURL string
+	CSVURL  string
+
+	Impersonation *Impersonation
+}
+
+// parseLoginQuery reads the search parameters q, outcome, user_id, since and
+// until (YYYY-MM-DD), and page.
+func parseLoginQuery(values url.Values) (LoginQuery, int, error) {
+	q := LoginQuery{
+		Text:    strings.TrimSpace(values.Get("q")),
+		Outcome: values.Get("outcome"),
+		Limit:   loginHistoryPageSize,
+	}
+
+	if v := values.Get("user_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return q, 0, fmt.Errorf("invalid user_id %q", v)
+		}
+		q.UserID = id
+	}
+
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+		days int
+	}{{"since", &q.Since, 0}, {"until", &q.Until, 1}} {
+		v := values.Get(p.name)
+		if v == "" {
+			continue
+		}
+
+		day, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return q, 0, fmt.Errorf("invalid %s %q", p.name, v)
+		}
+		*p.t = day.AddDate(0, 0, p.days)
+	}
+
+	page := 1
+	if v := values.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return q, 0, fmt.Errorf("invalid page %q", v)
+		}
+		page = n
+	}
+	q.Offset = (page - 1) * q.Limit
+
+	return q, page, nil
+}
+
+// historyURL returns the login history URL of the search with the given
+// name and value pairs replaced, or removed when the value is empty.
+func historyURL(values url.Values, params ...string) string {
+	v := url.Values{}
+	for key, list := range values {
+		v[key] = list
+	}
+
+	for i := 0; i+1 < len(params); i += 2 {
+		if params[i+1] == "" {
+			v.Del(params[i])
+		} else {
+			v.Set(params[i], params[i+1])
+		}
+	}
+
+	return "/login-history?" + v.Encode()
+}
+
+// loginHistoryPage displays the login history, a page at a time. With
+// ?format=csv every matching event is downloaded as CSV instead.
+func loginHistoryPage(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "cookie-name")
+	values := r.URL.Query()
+
+	q, page, err := parseLoginQuery(values)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, "Invalid search", err.Error())
+		return
+	}
+
+	if values.Get("format") == "csv" {
+		q.Limit, q.Offset = 0, 0
+		writeLoginHistoryCSV(w, q)
+		return
+	}
+
+	events, total, err := loginHistory.Search(q)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	p := LoginHistoryPage{
+		Query:  values,
+		Events: events,
+		Total:  total,
+		Page:   page,
+		Pages:  (total + loginHistoryPageSize - 1) / loginHistoryPageSize,
+		CSVURL: historyURL(values, "page", "", "format", "csv"),
+
+		Impersonation: sessionImpersonation(session),
+	}
+	if page > 1 {
+		p.PrevURL = historyURL(values, "page", strconv.Itoa(page-1))
+	}
+	if page < p.Pages {
+		p.NextURL = historyURL(values, "page", strconv.Itoa(page+1))
+	}
+
+	tmpl := template.Must(template.ParseFiles("./static/login_history.html", "./static/impersonation_banner.html"))
+	if err := tmpl.Execute(w, p); err != nil {
+		log.Panic(err)
+	}
+}
+
+func writeLoginHistoryCSV(w http.ResponseWriter, q LoginQuery) {
+	events, _, err := loginHistory.Search(q)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="login-history.csv"`)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{
+		"id", "time", "outcome", "connection", "provider", "organization",
+		"user_id", "profile_id", "email", "ip", "user_agent", "error",
+	})
+	for _, e := range events {
+		out.Write([]string{
+			strconv.FormatInt(e.ID, 10), e.Time.Format(time.RFC3339), csvCell(e.Outcome),
+			csvCell(e.Connection), csvCell(e.Provider), csvCell(e.Organization),
+			strconv.FormatInt(e.UserID, 10), csvCell(e.ProfileID), csvCell(e.Email),
+			csvCell(e.IP), csvCell(e.UserAgent), csvCell(e.Error),
+		})
+	}
+	out.Flush()
+}
+
+// csvCell keeps spreadsheets from running a value as a formula. User agents,
+// login hints and provider errors come from whoever is signing in, so values
+// that would start a formula are prefixed with a quote.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// apiLoginHistory returns a page of the login history as JSON.
+func apiLoginHistory(w http.ResponseWriter, r *http.Request) {
+	q, page, err := parseLoginQuery(r.URL.Query())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	events, total, err := loginHistory.Search(q)
+	if err != nil {
+		log.Printf("searching login history failed: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []LoginEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data":     events,
+		"total":    total,
+		"page":     page,
+		"per_page": loginHistoryPageSize,
+	})
+}
@@ -9,15 +9,16 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
+	"github.com/workos/workos-go/v3/pkg/organizations"
 	"github.com/workos/workos-go/v3/pkg/sso"
 )
 
 var (
-	key    = []byte("super-secret-key")
-	store  = sessions.NewCookieStore(key)
+	store  *serverStore
 	router = http.NewServeMux()
 )
 
@@ -25,39 +26,210 @@ type Profile struct {
 	First_name  string
 	Last_name   string
 	Raw_profile string
+	Token       string
+	Roles       []string
+
+	Impersonation *Impersonation
+}
+
+type ErrorPage struct {
+	Title   string
+	Message string
+	Details string
+
+	// RetryURL is where the user can try again, if trying again may help.
+	RetryURL string
+
+	// ContactAdmin asks the user to reach out to their administrator,
+	// quoting Reference.
+	ContactAdmin bool
+	Reference    string
 }
 
 var conf struct {
 	Addr        string
+	TLS         TLSConfig
+	Cookies     CookieConfig
 	APIKey      string
 	ClientID    string
 	RedirectURI string
 	Connection  string
 	Provider    string
+
+	ProvidersFile string
+
+	ReturnToPaths string
+
+	DomainsFile           string
+	DiscoverOrganizations bool
+
+	SessionStore string
+	SessionPath  string
+	SessionKeys  string
+
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+
+	RolesFile string
+
+	RateLimiter    string
+	RateLimitsFile string
+	MetricsAddr    string
+
+	ImpersonationMaxDuration time.Duration
+	AuditLog                 string
+
+	LinkRulesFile string
+
+	LoginHistoryStore string
+	LoginHistoryPath  string
+
+	Upstream string
+
+	UserStore string
+	UserPath  string
+
+	IssueJWT     bool
+	JWTAlgorithm string
+	JWTKeyFiles  string
+	JWTIssuer    string
+	JWTAudience  string
+	JWTTTL       time.Duration
+	JWTRotation  time.Duration
+
+	Mock         bool
+	MockAddr     string
+	MockProfiles string
 }
 
 func loadEnvVariables() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+	if err := godotenv.Load(); err != nil {
+		log.Print("No .env file found")
 	}
 
 	// Assign the environment variables to the `conf` struct fields
 	flag.StringVar(&conf.Addr, "addr", ":8000", "The server addr.")
+	registerTLSFlags(&conf.TLS)
+	registerCookieFlags(&conf.Cookies)
 	flag.StringVar(&conf.APIKey, "api-key", os.Getenv("WORKOS_API_KEY"), "The WorkOS API key.")
 	flag.StringVar(&conf.ClientID, "client-id", os.Getenv("WORKOS_CLIENT_ID"), "The WorkOS client id.")
 	flag.StringVar(&conf.RedirectURI, "redirect-uri", os.Getenv("WORKOS_REDIRECT_URI"), "The redirect uri.")
 	flag.StringVar(&conf.Connection, "connection", os.Getenv("WORKOS_CONNECTION"), "Use the Connection ID associated with your SSO Connection.")
 	flag.StringVar(&conf.Provider, "provider", "", "The OAuth provider used for the SSO connection.")
+	flag.StringVar(&conf.ProvidersFile, "providers", os.Getenv("PROVIDERS_FILE"), "A JSON file of the login methods offered on the login page.")
+	flag.StringVar(&conf.ReturnToPaths, "return-to-paths", "/logged_in,/sessions,/account,/users,/admin,/login-history", "Comma separated local paths users may be sent back to after signing in.")
+	flag.StringVar(&conf.DomainsFile, "domains", os.Getenv("WORKOS_DOMAINS_FILE"), "A JSON file mapping email domains to organizations or connections.")
+	flag.BoolVar(&conf.DiscoverOrganizations, "discover-organizations", os.Getenv("WORKOS_DISCOVER_ORGANIZATIONS") == "true", "Look up unmapped email domains in WorkOS organizations.")
+	flag.StringVar(&conf.SessionStore, "session-store", envOr("SESSION_STORE", "memory"), "Where sessions are kept: memory, file or sqlite.")
+	flag.StringVar(&conf.SessionPath, "session-path", os.Getenv("SESSION_PATH"), "The directory of the file session store or the database of the sqlite one.")
+	flag.StringVar(&conf.SessionKeys, "session-keys", os.Getenv("SESSION_KEYS"), "Comma separated session cookie signing keys, newest first.")
+	flag.DurationVar(&conf.IdleTimeout, "idle-timeout", 30*time.Minute, "How long a signed in session may be inactive before it expires, 0 to disable.")
+	flag.DurationVar(&conf.AbsoluteTimeout, "absolute-timeout", 12*time.Hour, "How long a signed in session lasts regardless of activity, 0 to disable.")
+	flag.StringVar(&conf.RolesFile, "roles", os.Getenv("ROLES_FILE"), "A JSON file of rules mapping SSO profiles to roles.")
+	flag.StringVar(&conf.RateLimiter, "rate-limiter", envOr("RATE_LIMITER", "memory"), "Where rate limit buckets are kept: memory.")
+	flag.StringVar(&conf.RateLimitsFile, "rate-limits", os.Getenv("RATE_LIMITS_FILE"), "A JSON file of the rate limits of the login routes.")
+	flag.StringVar(&conf.MetricsAddr, "metrics-addr", os.Getenv("METRICS_ADDR"), "Also serve /metrics without signing in on this addr, for Prometheus.")
+	flag.DurationVar(&conf.ImpersonationMaxDuration, "impersonation-max-duration", time.Hour, "How long an admin may impersonate another user.")
+	flag.StringVar(&conf.AuditLog, "audit-log", envOr("AUDIT_LOG", "audit.log"), "The file impersonations and account links are recorded to.")
+	flag.StringVar(&conf.LinkRulesFile, "link-rules", os.Getenv("LINK_RULES_FILE"), "A JSON file of rules deciding which logins with the same email are linked.")
+	flag.StringVar(&conf.LoginHistoryStore, "login-history-store", envOr("LOGIN_HISTORY_STORE", "sqlite"), "Where login attempts are recorded: sqlite or memory.")
+	flag.StringVar(&conf.LoginHistoryPath, "login-history-path", os.Getenv("LOGIN_HISTORY_PATH"), "The database of the sqlite login history.")
+	flag.StringVar(&conf.Upstream, "upstream", os.Getenv("GATEWAY_UPSTREAM"), "Proxy signed in users to this URL instead of serving the demo pages.")
+	flag.StringVar(&conf.UserStore, "user-store", envOr("USER_STORE", "sqlite"), "Where provisioned users are kept: sqlite or memory.")
+	flag.StringVar(&conf.UserPath, "user-path", os.Getenv("USER_PATH"), "The database of the sqlite user store.")
+	flag.BoolVar(&conf.IssueJWT, "issue-jwt", os.Getenv("ISSUE_JWT") == "true", "Issue signed JWTs to signed in users and publish the JWKS.")
+	flag.StringVar(&conf.JWTAlgorithm, "jwt-alg", "RS256", "The algorithm of generated JWT signing keys: RS256 or EdDSA.")
+	flag.StringVar(&conf.JWTKeyFiles, "jwt-key-files", os.Getenv("JWT_KEY_FILES"), "Comma separated PEM private keys, the first one signs JWTs.")
+	flag.StringVar(&conf.JWTIssuer, "jwt-issuer", os.Getenv("JWT_ISSUER"), "The issuer of JWTs, defaults to the server URL.")
+	flag.StringVar(&conf.JWTAudience, "jwt-audience", os.Getenv("JWT_AUDIENCE"), "The audience of JWTs.")
+	flag.DurationVar(&conf.JWTTTL, "jwt-ttl", time.Hour, "How long issued JWTs are valid.")
+	flag.DurationVar(&conf.JWTRotation, "jwt-rotation", 24*time.Hour, "How often generated JWT signing keys are rotated, 0 to disable.")
+	flag.BoolVar(&conf.Mock, "mock", os.Getenv("WORKOS_MOCK") == "true", "Use a local mock of the WorkOS API instead of api.workos.com.")
+	flag.StringVar(&conf.MockAddr, "mock-addr", ":8001", "The mock WorkOS API addr.")
+	flag.StringVar(&conf.MockProfiles, "mock-profiles", os.Getenv("WORKOS_MOCK_PROFILES"), "A JSON file with the profiles served by the mock WorkOS API.")
 	flag.Parse()
 
-	log.Printf("launching sso demo with configuration: %+v", conf)
+	if conf.Mock {
+		applyMockDefaults()
+	}
+
+	// Every path is proxied to the upstream, so users can be sent back to
+	// any of them.
+	if conf.Upstream != "" {
+		conf.ReturnToPaths += ",/"
+	}
+
+	if conf.JWTIssuer == "" {
+		conf.JWTIssuer = serverURL()
+	}
+
+	// The session keys can forge sessions, so they are kept out of the log.
+	logged := conf
+	logged.SessionKeys = redact(logged.SessionKeys)
+	log.Printf("launching sso demo with configuration: %+v", logged)
 
 	sso.Configure(conf.APIKey, conf.ClientID)
+	organizations.SetAPIKey(conf.APIKey)
+
+	var err error
+	if providers, err = loadProviders(conf.ProvidersFile); err != nil {
+		log.Fatal("Error loading providers file: ", err)
+	}
+
+	if tenants, err = loadTenants(conf.DomainsFile); err != nil {
+		log.Fatal("Error loading domains file: ", err)
+	}
+
+	backend, err := newSessionStore(conf.SessionStore, conf.SessionPath)
+	if err != nil {
+		log.Fatal("Error opening session store: ", err)
+	}
+	cookieOpts, err := conf.Cookies.Options(conf.TLS.Enabled())
+	if err != nil {
+		log.Fatal("Error in cookie options: ", err)
+	}
+	store = newServerStore(backend, sessionKeys(conf.SessionKeys), cookieOpts)
+
+	if rateLimits, err = loadRateLimits(conf.RateLimitsFile); err != nil {
+		log.Fatal("Error loading rate limits file: ", err)
+	}
+	if limiter, err = newRateLimiter(conf.RateLimiter); err != nil {
+		log.Fatal("Error creating rate limiter: ", err)
+	}
+
+	if roleRules, err = loadRoleRules(conf.RolesFile); err != nil {
+		log.Fatal("Error loading roles file: ", err)
+	}
+
+	if linkRules, err = loadLinkRules(conf.LinkRulesFile); err != nil {
+		log.Fatal("Error loading link rules file: ", err)
+	}
+
+	if users, err = newUserRepository(conf.UserStore, conf.UserPath); err != nil {
+		log.Fatal("Error opening user store: ", err)
+	}
+
+	if loginHistory, err = newLoginHistory(conf.LoginHistoryStore, conf.LoginHistoryPath); err != nil {
+		log.Fatal("Error opening login history: ", err)
+	}
 }
 
-func init() {
-	loadEnvVariables()
+// redact hides a secret configuration value, showing only whether it is set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// envOr returns the value of the environment variable, or def when it is
+// not set.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+
+	return def
 }
 
 func signin(w http.ResponseWriter, r *http.Request) {
@@ -66,17 +238,33 @@ func signin(w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 	}
 
+	returnTo := r.URL.Query().Get("return_to")
+
 	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+		rememberReturnTo(session, returnTo)
+		if err := session.Save(r, w); err != nil {
+			log.Panic(err)
+		}
+
 		http.Redirect(w, r, "/signin", http.StatusSeeOther)
 		return
 	}
 
+	if allowedReturnTo(returnTo) {
+		http.Redirect(w, r, returnTo, http.StatusSeeOther)
+		return
+	}
+
 	http.Redirect(w, r, "/logged_in", http.StatusSeeOther)
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "cookie-name")
-	session.Values["authenticated"] = false
+
+	endImpersonation(r, session, "logout")
+
+	// Revoke the session on the server, not just in this browser.
+	session.Options.MaxAge = -1
 
 	if err := session.Save(r, w); err != nil {
 		log.Panic(err)
@@ -85,101 +273,298 @@ func logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func getAuthorizationURL(loginType string) (*url.URL, error) {
-	opts := sso.GetAuthorizationURLOpts{
-		RedirectURI: conf.RedirectURI,
-	}
+// renderError displays the error page with the given status code.
+func renderError(w http.ResponseWriter, status int, title, message string) {
+	renderErrorPage(w, status, ErrorPage{Title: title, Message: message, RetryURL: "/"})
+}
 
-	if loginType == "saml" {
-		opts.Connection = conf.Connection
-	} else {
-		opts.Provider = sso.ConnectionType(loginType)
+func renderErrorPage(w http.ResponseWriter, status int, page ErrorPage) {
+	tmpl, err := template.ParseFiles("./static/error.html")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, page.Message, status)
+		return
 	}
 
-	return sso.GetAuthorizationURL(opts)
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Println(err)
+	}
 }
 
-func login(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		log.Panic(err)
+// startLogin redirects the user to WorkOS to sign in with the given options,
+// binding a fresh state to the session. The request form must be parsed.
+func startLogin(w http.ResponseWriter, r *http.Request, opts sso.GetAuthorizationURLOpts) {
+	session, _ := store.Get(r, "cookie-name")
+
+	returnTo := takeReturnTo(session)
+	if v := r.Form.Get("return_to"); allowedReturnTo(v) {
+		returnTo = v
 	}
 
-	loginType := r.Form.Get("login_method")
+	opts.RedirectURI = conf.RedirectURI
+	opts.State = newLoginState(session, returnTo)
+	session.Values["login_target"] = loginTarget(opts)
+	startLoginAttempt(r, session, opts)
 
-	url, err := getAuthorizationURL(loginType)
+	url, err := sso.GetAuthorizationURL(opts)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
 	http.Redirect(w, r, url.String(), http.StatusSeeOther)
 }
 
+// loginTarget describes the connection, organization or provider a login is
+// for, for logging.
+func loginTarget(opts sso.GetAuthorizationURLOpts) string {
+	switch {
+	case opts.Connection != "":
+		return "connection " + opts.Connection
+	case opts.Organization != "":
+		return "organization " + opts.Organization
+	default:
+		return "provider " + string(opts.Provider)
+	}
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		log.Panic(err)
+	}
+
+	provider, ok := providers.Lookup(r.Form.Get("login_method"))
+	if !ok {
+		recordLogin(r, LoginEvent{}, loginFailed, "unknown_login_method")
+		renderError(w, http.StatusBadRequest, "Unknown login method",
+			"The selected login method is not available. Please choose another one.")
+		return
+	}
+
+	opts := provider.AuthorizationOpts()
+	opts.LoginHint = r.Form.Get("login_hint")
+
+	startLogin(w, r, opts)
+}
+
 func callback(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("./static/logged_in.html"))
+	tmpl := template.Must(template.ParseFiles("./static/logged_in.html", "./static/impersonation_banner.html"))
 	log.Printf("callback is called with %s", r.URL)
 
+	// The state must be checked, and consumed, before the code is exchanged
+	// so that a forged or replayed callback never signs anyone in.
+	session, _ := store.Get(r, "cookie-name")
+	query := r.URL.Query()
+	target, _ := session.Values["login_target"].(string)
+	attempt := loginAttempt(session)
+	delete(session.Values, "login_attempt")
+
+	state := query.Get("state")
+	err := verifyLoginState(session, state)
+	if saveErr := session.Save(r, w); saveErr != nil {
+		log.Panic(saveErr)
+	}
+	if err != nil {
+		log.Printf("state verification failed: %s", err)
+		recordLogin(r, attempt, loginFailed, "invalid_state")
+		renderError(w, http.StatusBadRequest, "Your sign in could not be verified",
+			"This sign in request did not start from this browser, has already been used, or took too long to complete. Please sign in again.")
+		return
+	}
+
+	// The identity provider or WorkOS rejected the login.
+	if code := query.Get("error"); code != "" {
+		recordLogin(r, attempt, loginFailed, code)
+		renderCallbackError(w, classifyProviderError(code, query.Get("error_description")), target)
+		return
+	}
+	if query.Get("code") == "" {
+		recordLogin(r, attempt, loginFailed, "missing_code")
+		renderCallbackError(w, &CallbackError{Kind: errKindInvalidRequest, Code: "missing_code"}, target)
+		return
+	}
+
 	profile, err := sso.GetProfileAndToken(context.Background(), sso.GetProfileAndTokenOpts{
-		Code: r.URL.Query().Get("code"),
+		Code: query.Get("code"),
 	})
 	if err != nil {
-		log.Printf("get profile failed: %s", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		cbErr := classifyExchangeError(err)
+		recordLogin(r, attempt, loginFailed, cbErr.Code)
+		renderCallbackError(w, cbErr, target)
 		return
 	}
 
-	session, _ := store.Get(r, "cookie-name")
-	session.Values["authenticated"] = true
+	identity, err := provisionUser(profile.Profile)
+	if err != nil {
+		log.Printf("provisioning user failed: %s", err)
+		recordLogin(r, attempt, loginFailed, "provisioning_failed")
+		renderError(w, http.StatusInternalServerError, "We couldn't sign you in",
+			"Your account could not be set up. Please try again later.")
+		return
+	}
+
+	linked := completePendingLink(r, session, identity)
+
+	user, candidate, offer, err := linkSignedInUser(r, identity)
+	if err != nil {
+		log.Printf("linking user failed: %s", err)
+		recordLogin(r, attempt, loginFailed, "linking_failed")
+		renderError(w, http.StatusInternalServerError, "We couldn't sign you in",
+			"Your account could not be set up. Please try again later.")
+		return
+	}
+
+	if err := store.Renew(session); err != nil {
+		log.Panic(err)
+	}
+
+	startAuthenticatedSession(session)
+	recordSessionDevice(session, r)
+	session.Values["user_id"] = user.ID
+	session.Values["identity_id"] = identity.ID
+	delete(session.Values, "link_offer")
+	if offer {
+		session.Values["link_offer"] = candidate.ID
+	}
+	session.Values["roles"] = roleRules.Roles(profile.Profile)
 	session.Values["first_name"] = profile.Profile.FirstName
 	session.Values["last_name"] = profile.Profile.LastName
 	session.Values["raw_profile"], _ = json.MarshalIndent(profile, "", "    ")
 
+	if conf.IssueJWT {
+		token, err := issueToken(profileClaims(user.ID, profile.Profile, sessionRoles(session)))
+		if err != nil {
+			log.Panic(err)
+		}
+		session.Values["token"] = token
+	}
+
 	if err := session.Save(r, w); err != nil {
 		log.Panic(err)
 	}
 
-	thisProfile := Profile{
-		session.Values["first_name"].(string),
-		session.Values["last_name"].(string),
-		string(session.Values["raw_profile"].([]byte)),
+	recordLoginSuccess(r, attempt, profile.Profile, user)
+
+	if offer {
+		http.Redirect(w, r, "/account/link", http.StatusSeeOther)
+		return
+	}
+	if linked {
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	if returnTo := decodeReturnTo(state); returnTo != "" {
+		http.Redirect(w, r, returnTo, http.StatusSeeOther)
+		return
 	}
 
-	if err := tmpl.Execute(w, thisProfile); err != nil {
+	if err := tmpl.Execute(w, sessionProfile(session)); err != nil {
 		log.Panic(err)
 	}
 }
 
-func loggedin(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("./static/logged_in.html"))
-	session, _ := store.Get(r, "cookie-name")
+// sessionProfile returns the profile saved in the session by callback.
+func sessionProfile(session *sessions.Session) Profile {
+	firstName, _ := session.Values["first_name"].(string)
+	lastName, _ := session.Values["last_name"].(string)
+	rawProfile, _ := session.Values["raw_profile"].([]byte)
+	token, _ := session.Values["token"].(string)
 
-	thisProfile := Profile{
-		session.Values["first_name"].(string),
-		session.Values["last_name"].(string),
-		string(session.Values["raw_profile"].([]byte)),
+	return Profile{firstName, lastName, string(rawProfile), token, sessionRoles(session), sessionImpersonation(session)}
+}
+
+// sessionSSOProfile returns the WorkOS profile saved in the session.
+func sessionSSOProfile(session *sessions.Session) (sso.Profile, bool) {
+	rawProfile, ok := session.Values["raw_profile"].([]byte)
+	if !ok {
+		return sso.Profile{}, false
 	}
 
-	if err := tmpl.Execute(w, thisProfile); err != nil {
+	var profile sso.ProfileAndToken
+	if err := json.Unmarshal(rawProfile, &profile); err != nil {
+		log.Println(err)
+		return sso.Profile{}, false
+	}
+
+	return profile.Profile, true
+}
+
+func loggedin(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("./static/logged_in.html", "./static/impersonation_banner.html"))
+	session, _ := store.Get(r, "cookie-name")
+
+	if err := tmpl.Execute(w, sessionProfile(session)); err != nil {
 		log.Panic(err)
 	}
 }
 
 func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+	loadEnvVariables()
+
+	if conf.Mock {
+		startMockWorkOS()
 	}
 
-	router.HandleFunc("/login", login)
-	router.HandleFunc("/callback", callback)
-	router.HandleFunc("/logged_in", loggedin)
-	router.HandleFunc("/", signin)
-	router.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	router.Handle("/signin/", http.StripPrefix("/signin/", http.FileServer(http.Dir("static"))))
-	router.HandleFunc("/logout", logout)
+	go cleanupSessions(store.backend, 10*time.Minute)
 
-	if err := http.ListenAndServe(conf.Addr, router); err != nil {
+	registerRoutes()
+
+	if conf.MetricsAddr != "" {
+		startMetricsServer(conf.MetricsAddr)
+	}
+
+	if err := listenAndServe(conf.Addr, router, conf.TLS); err != nil {
 		log.Fatal("Error loading .env file: ", err)
 	}
 }
+
+// registerRoutes adds the handlers of the app to router.
+func registerRoutes() {
+	if conf.IssueJWT {
+		setupJWT()
+		router.HandleFunc("/.well-known/jwks.json", jwks)
+		router.Handle("/api/token", RequireAuth(http.HandlerFunc(apiToken)))
+	}
+
+	router.Handle("/login", RateLimit("/login", http.HandlerFunc(login)))
+	router.Handle("/discover", RateLimit("/discover", http.HandlerFunc(discover)))
+	router.Handle("/callback", RateLimit("/callback", http.HandlerFunc(callback)))
+	router.Handle("/metrics", RequireRole("admin", http.HandlerFunc(metrics)))
+	router.Handle("/logged_in", RequireAuth(http.HandlerFunc(loggedin)))
+	router.HandleFunc("/auth", forwardAuth)
+
+	if conf.Upstream != "" {
+		upstream, err := url.Parse(conf.Upstream)
+		if err != nil {
+			log.Fatal("Error parsing upstream URL: ", err)
+		}
+		router.Handle("/", newGateway(upstream))
+		log.Printf("proxying signed in users to %s", upstream)
+	} else {
+		router.HandleFunc("/", signin)
+	}
+	router.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	router.HandleFunc("/signin/", loginPage)
+	router.HandleFunc("/logout", logout)
+	router.Handle("/sessions", RequireAuth(http.HandlerFunc(mySessions)))
+	router.Handle("/sessions/revoke", RequireAuth(http.HandlerFunc(revokeMySession)))
+	router.Handle("/account", RequireAuth(http.HandlerFunc(account)))
+	router.Handle("/account/link", RequireAuth(http.HandlerFunc(linkAccount)))
+	router.Handle("/account/unlink", RequireAuth(http.HandlerFunc(unlinkAccount)))
+	router.Handle("/users", RequireRole("admin", http.HandlerFunc(listUsers)))
+	router.Handle("/admin/impersonate", RequireRole("admin", http.HandlerFunc(impersonate)))
+	router.Handle("/impersonate/stop", RequireAuth(http.HandlerFunc(stopImpersonating)))
+	router.Handle("/admin/sessions", RequireRole("admin", http.HandlerFunc(adminSessions)))
+	router.Handle("/admin/sessions/revoke", RequireRole("admin", http.HandlerFunc(adminRevokeSessions)))
+	router.Handle("/admin", RequireRole("admin", http.HandlerFunc(admin)))
+	router.Handle("/login-history", RequireRole("admin", http.HandlerFunc(loginHistoryPage)))
+	router.Handle("/api/login-history", RequireRole("admin", http.HandlerFunc(apiLoginHistory)))
+	router.Handle("/api/me", RequireAPIAuth(http.HandlerFunc(me)))
+}
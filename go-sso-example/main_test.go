@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/workos/workos-go/v3/pkg/organizations"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// app serves the routes of the app during the tests, signing in against the
+// mock WorkOS API.
+var app *httptest.Server
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "sso-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Setenv("WORKOS_MOCK", "true")
+	os.Setenv("USER_STORE", "memory")
+	os.Setenv("LOGIN_HISTORY_STORE", "memory")
+	os.Setenv("AUDIT_LOG", filepath.Join(dir, "audit.log"))
+	flag.Parse()
+	loadEnvVariables()
+
+	mock := httptest.NewServer(newMockWorkOS(conf.ClientID, conf.APIKey, defaultMockProfiles).handler())
+	sso.DefaultClient.Endpoint = mock.URL
+	organizations.DefaultClient.Endpoint = mock.URL
+
+	registerRoutes()
+	app = httptest.NewServer(router)
+	conf.RedirectURI = app.URL + "/callback"
+
+	code := m.Run()
+
+	app.Close()
+	mock.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newClient returns a client with its own cookies that doesn't follow
+// redirects, so that each step of a login can be checked.
+func newClient(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// startSignin starts a login with the login method and returns the mock
+// WorkOS authorization URL the user is sent to.
+func startSignin(t *testing.T, client *http.Client, method string) *url.URL {
+	res, err := client.PostForm(app.URL+"/login", url.Values{"login_method": {method}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("login returned %d, want %d", res.StatusCode, http.StatusSeeOther)
+	}
+	authorize, err := res.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authorize.String(), sso.DefaultClient.Endpoint+"/sso/authorize") {
+		t.Fatalf("login redirected to %s, want the mock authorization URL", authorize)
+	}
+
+	return authorize
+}
+
+// approveSignin signs in as the mock profile on the authorization page and
+// returns the callback URL the user is sent back to.
+func approveSignin(t *testing.T, client *http.Client, authorize *url.URL, profile string) string {
+	query := authorize.Query()
+	res, err := client.PostForm(sso.DefaultClient.Endpoint+"/sso/authorize", url.Values{
+		"profile":      {profile},
+		"state":        {query.Get("state")},
+		"redirect_uri": {query.Get("redirect_uri")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	callback, err := res.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(callback.String(), app.URL+"/callback?") {
+		t.Fatalf("mock WorkOS redirected to %s, want the callback", callback)
+	}
+
+	return callback.String()
+}
+
+// signIn signs the client in as the mock profile with the login method and
+// returns where the callback sends it, or "" when it shows the signed in
+// page itself.
+func signIn(t *testing.T, client *http.Client, method, profile string) string {
+	callback := approveSignin(t, client, startSignin(t, client, method), profile)
+
+	res, err := client.Get(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("callback returned %d, want the signed in page or a redirect", res.StatusCode)
+	}
+
+	return res.Header.Get("Location")
+}
+
+func get(t *testing.T, client *http.Client, u string) (int, string) {
+	res, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, string(body)
+}
+
+func TestSignin(t *testing.T) {
+	client := newClient(t)
+
+	if status, _ := get(t, client, app.URL+"/logged_in"); status != http.StatusSeeOther {
+		t.Fatalf("logged_in before signing in returned %d, want %d", status, http.StatusSeeOther)
+	}
+
+	callback := approveSignin(t, client, startSignin(t, client, "saml"), "prof_mock_saml")
+
+	// The user is sent back to the default return_to path.
+	if status, body := get(t, client, callback); status != http.StatusSeeOther {
+		t.Fatalf("callback returned %d, want %d: %s", status, http.StatusSeeOther, body)
+	}
+
+	status, body := get(t, client, app.URL+"/logged_in")
+	if status != http.StatusOK {
+		t.Fatalf("logged_in after signing in returned %d, want %d", status, http.StatusOK)
+	}
+	if !strings.Contains(body, "ada@example.com") {
+		t.Errorf("logged_in page doesn't show the signed in profile:\n%s", body)
+	}
+
+	// The state is consumed by the first callback.
+	if status, _ := get(t, client, callback); status != http.StatusBadRequest {
+		t.Errorf("replayed callback returned %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestSigninFromOtherBrowser(t *testing.T) {
+	callback := approveSignin(t, newClient(t), startSignin(t, newClient(t), "saml"), "prof_mock_saml")
+
+	other := newClient(t)
+	if status, _ := get(t, other, callback); status != http.StatusBadRequest {
+		t.Fatalf("callback in another browser returned %d, want %d", status, http.StatusBadRequest)
+	}
+	if status, _ := get(t, other, app.URL+"/logged_in"); status != http.StatusSeeOther {
+		t.Errorf("logged_in returned %d, want %d", status, http.StatusSeeOther)
+	}
+}
+
+func TestSigninDeepLink(t *testing.T) {
+	for _, page := range []string{"/account", "/sessions", "/logged_in?tab=groups"} {
+		t.Run(page, func(t *testing.T) {
+			client := newClient(t)
+
+			if status, _ := get(t, client, app.URL+page); status != http.StatusSeeOther {
+				t.Fatalf("%s before signing in returned %d, want %d", page, status, http.StatusSeeOther)
+			}
+
+			if location := signIn(t, client, "saml", "prof_mock_saml"); location != page {
+				t.Fatalf("signing in sent the user to %q, want back to %q", location, page)
+			}
+			if status, _ := get(t, client, app.URL+page); status != http.StatusOK {
+				t.Errorf("%s after signing in returned %d, want %d", page, status, http.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// startAuthenticatedSession marks the session as signed in. It must be saved
+// by the caller.
+func startAuthenticatedSession(session *sessions.Session) {
+	now := time.Now().Unix()
+	session.Values["authenticated"] = true
+	session.Values["authenticated_at"] = now
+	session.Values["last_seen_at"] = now
+}
+
+// sessionExpired reports whether a signed in session has been idle for too
+// long or has reached its absolute lifetime.
+func sessionExpired(session *sessions.Session, now time.Time) bool {
+	authenticatedAt, _ := session.Values["authenticated_at"].(int64)
+	lastSeenAt, _ := session.Values["last_seen_at"].(int64)
+
+	if conf.AbsoluteTimeout > 0 && now.Sub(time.Unix(authenticatedAt, 0)) > conf.AbsoluteTimeout {
+		return true
+	}
+	if conf.IdleTimeout > 0 && now.Sub(time.Unix(lastSeenAt, 0)) > conf.IdleTimeout {
+		return true
+	}
+
+	return false
+}
+
+// isAPIRequest reports whether the request comes from a program rather than a
+// browser page, in which case it gets a 401 instead of a login redirect.
+func isAPIRequest(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") || r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return true
+	}
+
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// authenticateSession returns the request session and whether it is signed
+// in. Sessions that are idle for longer than conf.IdleTimeout, or older than
+// conf.AbsoluteTimeout, are revoked. Signed in sessions have their idle timer
+// slid and are saved.
+func authenticateSession(w http.ResponseWriter, r *http.Request) (*sessions.Session, bool) {
+	session, err := store.Get(r, "cookie-name")
+	if err != nil {
+		log.Println(err)
+	}
+
+	now := time.Now()
+
+	if auth, _ := session.Values["authenticated"].(bool); !auth {
+		return session, false
+	}
+
+	if sessionExpired(session, now) {
+		log.Printf("session expired for %s", r.URL.Path)
+		// The audit log records the end of an impersonation however it
+		// ends.
+		endImpersonation(r, session, "session_expired")
+		if err := store.Renew(session); err != nil {
+			log.Panic(err)
+		}
+		session.Values = map[interface{}]interface{}{}
+		return session, false
+	}
+
+	expireImpersonation(r, session, now)
+
+	session.Values["last_seen_at"] = now.Unix()
+	if err := session.Save(r, w); err != nil {
+		log.Panic(err)
+	}
+
+	return session, true
+}
+
+// RequireAuth only lets signed in users through to next. Browsers are
+// redirected to the login page and API clients get a 401.
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := authenticateSession(w, r)
+		if !ok {
+			if isAPIRequest(r) {
+				writeUnauthorized(w)
+				return
+			}
+
+			redirectToSignin(w, r, session)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   "unauthenticated",
+		"message": "Sign in to access this resource.",
+	})
+}
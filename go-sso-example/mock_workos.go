@@ -0,0 +1,460 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/workos/workos-go/v3/pkg/organizations"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// mockCodeLifetime is how long an authorization code issued by the mock
+// server can be exchanged for a profile.
+const mockCodeLifetime = 10 * time.Minute
+
+// defaultMockProfiles are served by the mock server when no profiles file is
+// given. There is one profile per login method of the default and example
+// login pages.
+var defaultMockProfiles = []sso.Profile{
+	{
+		ID:             "prof_mock_google",
+		IdpID:          "100000000000000000001",
+		ConnectionID:   "conn_mock_google",
+		ConnectionType: sso.GoogleOAuth,
+		Email:          "grace@example.com",
+		FirstName:      "Grace",
+		LastName:       "Hopper",
+		RawAttributes:  map[string]interface{}{"hd": "example.com"},
+	},
+	{
+		ID:             "prof_mock_microsoft",
+		IdpID:          "00000000-0000-0000-0000-000000000002",
+		ConnectionID:   "conn_mock_microsoft",
+		ConnectionType: sso.MicrosoftOAuth,
+		Email:          "alan@example.com",
+		FirstName:      "Alan",
+		LastName:       "Turing",
+		RawAttributes:  map[string]interface{}{},
+	},
+	{
+		ID:             "prof_mock_saml",
+		IdpID:          "00u000000000003",
+		OrganizationID: "org_mock",
+		ConnectionID:   "conn_mock_saml",
+		ConnectionType: sso.OktaSAML,
+		Email:          "ada@example.com",
+		FirstName:      "Ada",
+		LastName:       "Lovelace",
+		Groups:         []string{"Engineering", "Admins"},
+		RawAttributes: map[string]interface{}{
+			"email":     "ada@example.com",
+			"firstName": "Ada",
+			"lastName":  "Lovelace",
+			"groups":    []interface{}{"Engineering", "Admins"},
+		},
+	},
+	{
+		ID:             "prof_mock_github",
+		IdpID:          "1000004",
+		ConnectionID:   "conn_mock_github",
+		ConnectionType: GitHubOAuth,
+		Email:          "margaret@example.com",
+		FirstName:      "Margaret",
+		LastName:       "Hamilton",
+		RawAttributes:  map[string]interface{}{},
+	},
+	{
+		ID:             "prof_mock_oidc",
+		IdpID:          "00000000-0000-0000-0000-000000000005",
+		OrganizationID: "org_mock_globex",
+		ConnectionID:   "conn_mock_oidc",
+		ConnectionType: sso.GenericOIDC,
+		Email:          "edsger@globex.test",
+		FirstName:      "Edsger",
+		LastName:       "Dijkstra",
+		RawAttributes:  map[string]interface{}{"email": "edsger@globex.test"},
+	},
+}
+
+// mockGrant is an authorization code waiting to be exchanged.
+type mockGrant struct {
+	profile   sso.Profile
+	expiresAt time.Time
+}
+
+// mockWorkOS is a local stand-in for the parts of the WorkOS SSO API used by
+// this example: the authorization redirect, the code exchange and the
+// profile lookup.
+type mockWorkOS struct {
+	clientID string
+	apiKey   string
+	profiles []sso.Profile
+
+	mu     sync.Mutex
+	codes  map[string]mockGrant
+	tokens map[string]sso.Profile
+}
+
+type mockAuthorizeData struct {
+	Profiles    []sso.Profile
+	Request     string
+	RedirectURI string
+	State       string
+}
+
+func newMockWorkOS(clientID, apiKey string, profiles []sso.Profile) *mockWorkOS {
+	return &mockWorkOS{
+		clientID: clientID,
+		apiKey:   apiKey,
+		profiles: profiles,
+		codes:    make(map[string]mockGrant),
+		tokens:   make(map[string]sso.Profile),
+	}
+}
+
+// loadMockProfiles reads a JSON array of profiles, in the same format the
+// WorkOS API returns them, from the given file.
+func loadMockProfiles(path string) ([]sso.Profile, error) {
+	if path == "" {
+		return defaultMockProfiles, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []sso.Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+// randomToken returns a random hex encoded string built from n bytes.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func (m *mockWorkOS) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sso/authorize", m.authorize)
+	mux.HandleFunc("/sso/token", m.token)
+	mux.HandleFunc("/sso/profile", m.profile)
+	mux.HandleFunc("/organizations", m.organizations)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	return mux
+}
+
+// matchingProfiles returns the profiles that may sign in for the connection,
+// organization or provider requested in the authorization URL.
+func (m *mockWorkOS) matchingProfiles(query url.Values) []sso.Profile {
+	var profiles []sso.Profile
+
+	for _, p := range m.profiles {
+		switch {
+		case query.Get("connection") != "":
+			if p.ConnectionID != query.Get("connection") {
+				continue
+			}
+		case query.Get("organization") != "":
+			if p.OrganizationID != query.Get("organization") {
+				continue
+			}
+		case query.Get("provider") != "":
+			if string(p.ConnectionType) != query.Get("provider") {
+				continue
+			}
+		}
+		profiles = append(profiles, p)
+	}
+
+	return profiles
+}
+
+func (m *mockWorkOS) authorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		m.approve(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+
+	if query.Get("client_id") != m.clientID {
+		http.Error(w, "Invalid client ID.", http.StatusBadRequest)
+		return
+	}
+	if query.Get("response_type") != "code" {
+		http.Error(w, "Unsupported response type.", http.StatusBadRequest)
+		return
+	}
+	if _, err := url.ParseRequestURI(query.Get("redirect_uri")); err != nil {
+		http.Error(w, "Invalid redirect URI.", http.StatusBadRequest)
+		return
+	}
+
+	var request []string
+	for _, param := range []string{"connection", "organization", "provider", "login_hint", "domain_hint"} {
+		if v := query.Get(param); v != "" {
+			request = append(request, param+"="+v)
+		}
+	}
+
+	tmpl := template.Must(template.ParseFiles("./static/mock_authorize.html"))
+	data := mockAuthorizeData{
+		Profiles:    m.matchingProfiles(query),
+		Request:     strings.Join(request, ", "),
+		RedirectURI: query.Get("redirect_uri"),
+		State:       query.Get("state"),
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Panic(err)
+	}
+}
+
+// approve completes the mock sign in by redirecting back to the application
+// with either a fresh authorization code or an error.
+func (m *mockWorkOS) approve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.ParseRequestURI(r.Form.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "Invalid redirect URI.", http.StatusBadRequest)
+		return
+	}
+
+	query := redirect.Query()
+	if state := r.Form.Get("state"); state != "" {
+		query.Set("state", state)
+	}
+
+	if r.Form.Get("action") == "deny" {
+		query.Set("error", "access_denied")
+		query.Set("error_description", "The user denied the sign in request.")
+		redirect.RawQuery = query.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusSeeOther)
+		return
+	}
+
+	var profile *sso.Profile
+	for i := range m.profiles {
+		if m.profiles[i].ID == r.Form.Get("profile") {
+			profile = &m.profiles[i]
+		}
+	}
+	if profile == nil {
+		http.Error(w, "Unknown profile.", http.StatusBadRequest)
+		return
+	}
+
+	code := randomToken(16)
+
+	m.mu.Lock()
+	m.codes[code] = mockGrant{
+		profile:   *profile,
+		expiresAt: time.Now().Add(mockCodeLifetime),
+	}
+	m.mu.Unlock()
+
+	query.Set("code", code)
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusSeeOther)
+}
+
+func (m *mockWorkOS) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeMockError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	if r.Form.Get("client_id") != m.clientID || r.Form.Get("client_secret") != m.apiKey {
+		writeMockError(w, http.StatusBadRequest, "invalid_client", "Invalid client ID or secret.")
+		return
+	}
+	if r.Form.Get("grant_type") != "authorization_code" {
+		writeMockError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant type.")
+		return
+	}
+
+	code := r.Form.Get("code")
+
+	// Codes are single use, so they are removed whether or not they are
+	// still valid.
+	m.mu.Lock()
+	grant, ok := m.codes[code]
+	delete(m.codes, code)
+	m.mu.Unlock()
+
+	if !ok || time.Now().After(grant.expiresAt) {
+		writeMockError(w, http.StatusBadRequest, "invalid_grant", "The code '"+code+"' has expired or is invalid.")
+		return
+	}
+
+	accessToken := randomToken(16)
+
+	m.mu.Lock()
+	m.tokens[accessToken] = grant.profile
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sso.ProfileAndToken{
+		AccessToken: accessToken,
+		Profile:     grant.profile,
+	})
+}
+
+func (m *mockWorkOS) profile(w http.ResponseWriter, r *http.Request) {
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	m.mu.Lock()
+	profile, ok := m.tokens[accessToken]
+	m.mu.Unlock()
+
+	if !ok {
+		writeMockError(w, http.StatusUnauthorized, "invalid_token", "The access token is invalid.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// organizations lists the organizations of the mock profiles, each owning the
+// email domains of its profiles, optionally filtered by domain.
+func (m *mockWorkOS) organizations(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+m.apiKey {
+		writeMockError(w, http.StatusUnauthorized, "unauthorized", "Invalid API key.")
+		return
+	}
+
+	filter := map[string]bool{}
+	for _, domain := range r.URL.Query()["domains[]"] {
+		filter[strings.ToLower(domain)] = true
+	}
+
+	var orgs []organizations.Organization
+	index := map[string]int{}
+	seen := map[string]bool{}
+
+	for _, p := range m.profiles {
+		domain, ok := emailDomain(p.Email)
+		if p.OrganizationID == "" || !ok || seen[p.OrganizationID+"/"+domain] {
+			continue
+		}
+		seen[p.OrganizationID+"/"+domain] = true
+
+		i, ok := index[p.OrganizationID]
+		if !ok {
+			i = len(orgs)
+			index[p.OrganizationID] = i
+			orgs = append(orgs, organizations.Organization{ID: p.OrganizationID, Name: p.OrganizationID})
+		}
+		orgs[i].Domains = append(orgs[i].Domains, organizations.OrganizationDomain{
+			ID:     "org_domain_" + domain,
+			Domain: domain,
+		})
+	}
+
+	data := []organizations.Organization{}
+	for _, org := range orgs {
+		for _, d := range org.Domains {
+			if len(filter) == 0 || filter[d.Domain] {
+				data = append(data, org)
+				break
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(organizations.ListOrganizationsResponse{Data: data})
+}
+
+func writeMockError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// localURL returns the http URL at which a server listening on addr can be
+// reached from this machine.
+func localURL(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+
+	return "http://" + addr
+}
+
+// serverURL returns the URL at which this server can be reached from this
+// machine.
+func serverURL() string {
+	if conf.TLS.Enabled() {
+		return "https" + strings.TrimPrefix(localURL(conf.Addr), "http")
+	}
+	return localURL(conf.Addr)
+}
+
+// applyMockDefaults fills in the WorkOS settings that are not needed when
+// running against the mock server, so that no .env file is required.
+func applyMockDefaults() {
+	if conf.APIKey == "" {
+		conf.APIKey = "sk_test_mock"
+	}
+	if conf.ClientID == "" {
+		conf.ClientID = "client_mock"
+	}
+	if conf.RedirectURI == "" {
+		conf.RedirectURI = serverURL() + "/callback"
+	}
+	if conf.Connection == "" {
+		conf.Connection = "conn_mock_saml"
+	}
+}
+
+// startMockWorkOS serves the mock WorkOS API on conf.MockAddr and points the
+// SSO client at it.
+func startMockWorkOS() {
+	profiles, err := loadMockProfiles(conf.MockProfiles)
+	if err != nil {
+		log.Fatal("Error loading mock profiles: ", err)
+	}
+
+	mock := newMockWorkOS(conf.ClientID, conf.APIKey, profiles)
+
+	sso.DefaultClient.Endpoint = localURL(conf.MockAddr)
+	organizations.DefaultClient.Endpoint = localURL(conf.MockAddr)
+
+	go func() {
+		if err := http.ListenAndServe(conf.MockAddr, mock.handler()); err != nil {
+			log.Fatal("Error starting mock WorkOS server: ", err)
+		}
+	}()
+
+	log.Printf("serving mock WorkOS API at %s with %d profiles", sso.DefaultClient.Endpoint, len(profiles))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// GitHubOAuth is not one of the connection types declared by the SDK yet.
+const GitHubOAuth sso.ConnectionType = "GitHubOAuth"
+
+// oauthProviders are the providers that can be passed to WorkOS as the
+// `provider` of an authorization URL.
+var oauthProviders = map[sso.ConnectionType]string{
+	sso.GoogleOAuth:    "google_button",
+	sso.MicrosoftOAuth: "microsoft_button",
+	GitHubOAuth:        "github_button",
+}
+
+// The kinds of login methods a LoginProvider can be.
+const (
+	providerOAuth        = "oauth"
+	providerConnection   = "connection"
+	providerOrganization = "organization"
+)
+
+var providerIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// LoginProvider is a button on the login page. Its ID is the `login_method`
+// submitted to /login.
+type LoginProvider struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+
+	// Type is "oauth", "connection" or "organization" and decides which of
+	// Provider, Connection or Organization is sent to WorkOS.
+	Type         string             `json:"type"`
+	Provider     sso.ConnectionType `json:"provider,omitempty"`
+	Connection   string             `json:"connection,omitempty"`
+	Organization string             `json:"organization,omitempty"`
+}
+
+// ButtonClass returns the CSS class the login page styles the button with.
+func (p LoginProvider) ButtonClass() string {
+	if class, ok := oauthProviders[p.Provider]; ok && p.Type == providerOAuth {
+		return class
+	}
+	return "saml_button"
+}
+
+// AuthorizationOpts returns the options to start a login with the provider.
+func (p LoginProvider) AuthorizationOpts() sso.GetAuthorizationURLOpts {
+	switch p.Type {
+	case providerConnection:
+		return sso.GetAuthorizationURLOpts{Connection: p.Connection}
+	case providerOrganization:
+		return sso.GetAuthorizationURLOpts{Organization: p.Organization}
+	default:
+		return sso.GetAuthorizationURLOpts{Provider: p.Provider}
+	}
+}
+
+func (p LoginProvider) validate() error {
+	if !providerIDPattern.MatchString(p.ID) {
+		return fmt.Errorf("invalid provider id %q", p.ID)
+	}
+	if p.Label == "" {
+		return fmt.Errorf("provider %s has no label", p.ID)
+	}
+
+	switch p.Type {
+	case providerOAuth:
+		if _, ok := oauthProviders[p.Provider]; !ok {
+			return fmt.Errorf("provider %s: unsupported oauth provider %q", p.ID, p.Provider)
+		}
+	case providerConnection:
+		if p.Connection == "" {
+			return fmt.Errorf("provider %s has no connection", p.ID)
+		}
+	case providerOrganization:
+		if p.Organization == "" {
+			return fmt.Errorf("provider %s has no organization", p.ID)
+		}
+	default:
+		return fmt.Errorf("provider %s: unknown type %q", p.ID, p.Type)
+	}
+
+	return nil
+}
+
+// ProviderRegistry is the ordered list of login methods offered on the login
+// page.
+type ProviderRegistry struct {
+	Providers []LoginProvider `json:"providers"`
+}
+
+// Lookup returns the provider with the given login method.
+func (r ProviderRegistry) Lookup(id string) (LoginProvider, bool) {
+	for _, p := range r.Providers {
+		if p.ID == id {
+			return p, true
+		}
+	}
+
+	return LoginProvider{}, false
+}
+
+// OAuth returns the OAuth providers, which anyone can sign in with whatever
+// their email domain.
+func (r ProviderRegistry) OAuth() []LoginProvider {
+	var oauth []LoginProvider
+	for _, p := range r.Providers {
+		if p.Type == providerOAuth {
+			oauth = append(oauth, p)
+		}
+	}
+
+	return oauth
+}
+
+// providers are loaded from conf.ProvidersFile at startup.
+var providers ProviderRegistry
+
+// defaultProviders offers Google, Microsoft and, when conf.Connection is set,
+// the SAML connection, under the login methods the login page always used.
+func defaultProviders() ProviderRegistry {
+	registry := ProviderRegistry{Providers: []LoginProvider{
+		{ID: "GoogleOAuth", Label: "Google OAuth", Type: providerOAuth, Provider: sso.GoogleOAuth},
+		{ID: "MicrosoftOAuth", Label: "Microsoft OAuth", Type: providerOAuth, Provider: sso.MicrosoftOAuth},
+	}}
+
+	if conf.Connection != "" {
+		registry.Providers = append(registry.Providers, LoginProvider{
+			ID:         "saml",
+			Label:      "Enterprise SAML",
+			Type:       providerConnection,
+			Connection: conf.Connection,
+		})
+	}
+
+	return registry
+}
+
+func loadProviders(path string) (ProviderRegistry, error) {
+	if path == "" {
+		return defaultProviders(), nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ProviderRegistry{}, err
+	}
+
+	var registry ProviderRegistry
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return ProviderRegistry{}, err
+	}
+
+	seen := map[string]bool{}
+	for _, p := range registry.Providers {
+		if err := p.validate(); err != nil {
+			return ProviderRegistry{}, err
+		}
+		if seen[p.ID] {
+			return ProviderRegistry{}, fmt.Errorf("duplicate provider id %q", p.ID)
+		}
+		seen[p.ID] = true
+	}
+
+	return registry, nil
+}
+
+// loginPage renders the login page with a button for every provider.
+func loginPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/signin/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Forward authentication sends users here with the page they asked
+	// for.
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		session, _ := store.Get(r, "cookie-name")
+		rememberReturnTo(session, returnTo)
+		if err := session.Save(r, w); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	tmpl := template.Must(template.ParseFiles("./static/index.html"))
+	if err := tmpl.Execute(w, providers); err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// duration is a time.Duration written as a string, eg. "1m", in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+	return nil
+}
+
+// Limit lets Requests requests through every Per, in bursts of up to Burst
+// requests.
+type Limit struct {
+	Requests int      `json:"requests"`
+	Per      duration `json:"per"`
+	Burst    int      `json:"burst"`
+}
+
+// rate returns how many tokens are added to the bucket every second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / time.Duration(l.Per).Seconds()
+}
+
+// capacity returns how many tokens the bucket holds.
+func (l Limit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// RouteLimits are the limits of a route. A nil limit is not enforced.
+type RouteLimits struct {
+	PerIP      *Limit `json:"per_ip"`
+	PerSession *Limit `json:"per_session"`
+}
+
+// rateLimits are keyed by route and replaced by conf.RateLimitsFile when it
+// is set.
+var rateLimits = map[string]RouteLimits{
+	"/login": {
+		PerIP:      &Limit{Requests: 30, Per: duration(time.Minute), Burst: 10},
+		PerSession: &Limit{Requests: 10, Per: duration(time.Minute), Burst: 5},
+	},
+	"/discover": {
+		PerIP:      &Limit{Requests: 30, Per: duration(time.Minute), Burst: 10},
+		PerSession: &Limit{Requests: 10, Per: duration(time.Minute), Burst: 5},
+	},
+	"/callback": {
+		PerIP:      &Limit{Requests: 30, Per: duration(time.Minute), Burst: 10},
+		PerSession: &Limit{Requests: 10, Per: duration(time.Minute), Burst: 5},
+	},
+}
+
+func loadRateLimits(path string) (map[string]RouteLimits, error) {
+	if path == "" {
+		return rateLimits, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var limits map[string]RouteLimits
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return nil, err
+	}
+
+	for route, l := range limits {
+		for _, limit := range []*Limit{l.PerIP, l.PerSession} {
+			if limit != nil && (limit.Requests <= 0 || limit.Per <= 0 || limit.Burst < 0) {
+				return nil, fmt.Errorf("invalid limit for %s", route)
+			}
+		}
+	}
+
+	return limits, nil
+}
+
+// RateLimiter keeps a token bucket per key. Implementations backed by a
+// shared store let several instances enforce the same limits.
+type RateLimiter interface {
+	// Allow takes a token from the bucket of key. When the bucket is empty
+	// it returns false and how long until a token is available.
+	Allow(key string, limit Limit) (bool, time.Duration, error)
+
+	// Refund puts back a token Allow took, up to the capacity of the
+	// bucket.
+	Refund(key string, limit Limit) error
+}
+
+// newRateLimiter returns the rate limiter selected by name.
+func newRateLimiter(name string) (RateLimiter, error) {
+	switch name {
+	case "memory":
+		return newMemoryRateLimiter(), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiter %q", name)
+	}
+}
+
+// limiter enforces rateLimits.
+var limiter RateLimiter
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// memoryRateLimiter keeps buckets in memory. Limits are per instance.
+type memoryRateLimiter struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	prunedAt time.Time
+
+	// now is time.Now, except in tests.
+	now func() time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{buckets: make(map[string]*bucket), prunedAt: time.Now(), now: time.Now}
+}
+
+func (m *memoryRateLimiter) Allow(key string, limit Limit) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.prune(now)
+
+	b := m.refill(key, limit, now)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit.rate() * float64(time.Second))
+		return false, wait, nil
+	}
+
+	b.tokens--
+	b.fullAt = now.Add(time.Duration((limit.capacity() - b.tokens) / limit.rate() * float64(time.Second)))
+	return true, 0, nil
+}
+
+func (m *memoryRateLimiter) Refund(key string, limit Limit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	b := m.refill(key, limit, now)
+	b.tokens = math.Min(limit.capacity(), b.tokens+1)
+	b.fullAt = now.Add(time.Duration((limit.capacity() - b.tokens) / limit.rate() * float64(time.Second)))
+	return nil
+}
+
+// refill returns the bucket of key with the tokens added since it was last
+// used. m.mu must be locked.
+func (m *memoryRateLimiter) refill(key string, limit Limit, now time.Time) *bucket {
+	capacity := limit.capacity()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updatedAt: now}
+		m.buckets[key] = b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updatedAt).Seconds()*limit.rate())
+	b.updatedAt = now
+	return b
+}
+
+// prune forgets the buckets that have filled up again, at most once a
+// minute.
+func (m *memoryRateLimiter) prune(now time.Time) {
+	if now.Sub(m.prunedAt) < time.Minute {
+		return
+	}
+	m.prunedAt = now
+
+	for key, b := range m.buckets {
+		if now.After(b.fullAt) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+type rateLimitMetric struct {
+	route  string
+	scope  string
+	result string
+}
+
+// rateLimitMetrics count the requests checked against the limits.
+var rateLimitMetrics = struct {
+	sync.Mutex
+	counts map[rateLimitMetric]int64
+}{counts: make(map[rateLimitMetric]int64)}
+
+func countRateLimit(route, scope, result string) {
+	rateLimitMetrics.Lock()
+	defer rateLimitMetrics.Unlock()
+
+	rateLimitMetrics.counts[rateLimitMetric{route, scope, result}]++
+}
+
+// metrics exposes the rate limit counters in the Prometheus text format.
+func metrics(w http.ResponseWriter, r *http.Request) {
+	rateLimitMetrics.Lock()
+	counts := make(map[rateLimitMetric]int64, len(rateLimitMetrics.counts))
+	keys := make([]rateLimitMetric, 0, len(rateLimitMetrics.counts))
+	for key, count := range rateLimitMetrics.counts {
+		counts[key] = count
+		keys = append(keys, key)
+	}
+	rateLimitMetrics.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.scope != b.scope {
+			return a.scope < b.scope
+		}
+		return a.result < b.result
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP sso_rate_limit_requests_total Requests checked against rate limits, by route, scope and result.")
+	fmt.Fprintln(w, "# TYPE sso_rate_limit_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "sso_rate_limit_requests_total{route=%q,scope=%q,result=%q} %d\n",
+			key.route, key.scope, key.result, counts[key])
+	}
+}
+
+// startMetricsServer serves the metrics on addr, which is meant to be
+// reachable by Prometheus but not from the internet.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metrics)
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal("Error starting metrics server: ", err)
+		}
+	}()
+
+	log.Printf("serving metrics at %s/metrics", localURL(addr))
+}
+
+// RateLimit enforces the limits of route before passing requests on to next.
+// Requests over a limit get a 429 with a Retry-After header.
+func RateLimit(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits, ok := rateLimits[route]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, _ := store.Get(r, "cookie-name")
+
+		// The session is checked first so that a session over its limit
+		// doesn't use up the tokens of everyone sharing its IP address.
+		type limitCheck struct {
+			scope string
+			key   string
+			limit *Limit
+		}
+		checks := []limitCheck{
+			{"session", session.ID, limits.PerSession},
+			{"ip", clientIP(r), limits.PerIP},
+		}
+
+		var taken []limitCheck
+		for _, check := range checks {
+			// New visitors have no session yet and are only limited by IP.
+			if check.limit == nil || check.key == "" {
+				continue
+			}
+
+			allowed, wait, err := limiter.Allow(route+" "+check.scope+" "+check.key, *check.limit)
+			if err != nil {
+				log.Printf("rate limiter failed: %s", err)
+				continue
+			}
+
+			if !allowed {
+				// Only requests that get through use tokens, so the
+				// ones taken by the earlier checks are put back.
+				for _, c := range taken {
+					if err := limiter.Refund(route+" "+c.scope+" "+c.key, *c.limit); err != nil {
+						log.Printf("rate limiter failed: %s", err)
+					}
+				}
+
+				countRateLimit(route, check.scope, "limited")
+				log.Printf("rate limited %s by %s for %s", route, check.scope, clientIP(r))
+				writeRateLimited(w, r, wait)
+				return
+			}
+			taken = append(taken, check)
+		}
+
+		for _, check := range taken {
+			countRateLimit(route, check.scope, "allowed")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeRateLimited(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	if isAPIRequest(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":       "rate_limited",
+			"message":     "Too many requests, please try again later.",
+			"retry_after": seconds,
+		})
+		return
+	}
+
+	renderError(w, http.StatusTooManyRequests, "Too many sign in attempts",
+		fmt.Sprintf("Please wait %d seconds and try again.", seconds))
+}
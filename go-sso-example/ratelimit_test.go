@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// newTestRateLimiter returns a memory rate limiter whose time only moves
+// when the returned function is called.
+func newTestRateLimiter() (*memoryRateLimiter, func(time.Duration)) {
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+
+	m := newMemoryRateLimiter()
+	m.prunedAt = now
+	m.now = func() time.Time { return now }
+
+	return m, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	m, advance := newTestRateLimiter()
+	limit := Limit{Requests: 60, Per: duration(time.Minute), Burst: 3}
+
+	allow := func(want bool, wantWait time.Duration) {
+		t.Helper()
+		allowed, wait, err := m.Allow("key", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != want || wait != wantWait {
+			t.Fatalf("Allow returned %t and %s, want %t and %s", allowed, wait, want, wantWait)
+		}
+	}
+
+	// A new bucket is full, and lets a burst through.
+	allow(true, 0)
+	allow(true, 0)
+	allow(true, 0)
+	allow(false, time.Second)
+
+	// Tokens are added at the rate of the limit.
+	advance(400 * time.Millisecond)
+	allow(false, 600*time.Millisecond)
+	advance(600 * time.Millisecond)
+	allow(true, 0)
+	allow(false, time.Second)
+
+	// The bucket never holds more than the burst.
+	advance(time.Hour)
+	allow(true, 0)
+	allow(true, 0)
+	allow(true, 0)
+	allow(false, time.Second)
+
+	// Other keys have their own bucket.
+	if allowed, _, _ := m.Allow("other", limit); !allowed {
+		t.Error("the bucket of another key is empty")
+	}
+}
+
+func TestMemoryRateLimiterWithoutBurst(t *testing.T) {
+	m, _ := newTestRateLimiter()
+	limit := Limit{Requests: 5, Per: duration(time.Minute)}
+
+	for i := 0; i < 5; i++ {
+		if allowed, _, _ := m.Allow("key", limit); !allowed {
+			t.Fatalf("request %d was limited, want a burst of the requests of the limit", i)
+		}
+	}
+	if allowed, wait, _ := m.Allow("key", limit); allowed || wait != 12*time.Second {
+		t.Errorf("Allow returned %t and %s, want false and 12s", allowed, wait)
+	}
+}
+
+func TestMemoryRateLimiterRefund(t *testing.T) {
+	m, _ := newTestRateLimiter()
+	limit := Limit{Requests: 60, Per: duration(time.Minute), Burst: 1}
+
+	m.Allow("key", limit)
+	if err := m.Refund("key", limit); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _, _ := m.Allow("key", limit); !allowed {
+		t.Fatal("the refunded token can't be used")
+	}
+
+	// Refunds don't fill the bucket over its capacity.
+	m.Refund("key", limit)
+	m.Refund("key", limit)
+	m.Allow("key", limit)
+	if allowed, _, _ := m.Allow("key", limit); allowed {
+		t.Error("refunds filled the bucket over its capacity")
+	}
+}
+
+// useRateLimits enforces the limits on "/limited" with a test rate limiter
+// for the rest of the test.
+func useRateLimits(t *testing.T, limits RouteLimits) func(time.Duration) {
+	savedLimits, savedLimiter := rateLimits, limiter
+	t.Cleanup(func() {
+		rateLimits, limiter = savedLimits, savedLimiter
+	})
+
+	m, advance := newTestRateLimiter()
+	limiter = m
+	rateLimits = map[string]RouteLimits{"/limited": limits}
+
+	return advance
+}
+
+// newTestSessionCookie returns the cookie of a new session of the app.
+func newTestSessionCookie(t *testing.T) *http.Cookie {
+	session := sessions.NewSession(store, "cookie-name")
+	opts := *store.options
+	session.Options = &opts
+	session.Values["return_to"] = "/logged_in"
+
+	return saveTestSession(t, store, session)
+}
+
+// limitedRequest sends a request to a rate limited handler from the IP
+// address, with the session cookie if it is not nil.
+func limitedRequest(ip string, cookie *http.Cookie, api bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/limited", nil)
+	r.RemoteAddr = ip + ":1234"
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	if api {
+		r.Header.Set("Accept", "application/json")
+	}
+
+	w := httptest.NewRecorder()
+	RateLimit("/limited", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimit(t *testing.T) {
+	advance := useRateLimits(t, RouteLimits{
+		PerIP:      &Limit{Requests: 2, Per: duration(time.Minute), Burst: 1},
+		PerSession: &Limit{Requests: 60, Per: duration(time.Minute), Burst: 2},
+	})
+	cookie := newTestSessionCookie(t)
+
+	if w := limitedRequest("192.0.2.1", cookie, false); w.Code != http.StatusNoContent {
+		t.Fatalf("first request returned %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	w := limitedRequest("192.0.2.1", cookie, false)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the IP limit returned %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "30" {
+		t.Errorf("Retry-After is %q, want %q", retry, "30")
+	}
+
+	// The request the IP limit rejected didn't use a token of the session,
+	// which has one left.
+	if w := limitedRequest("192.0.2.2", cookie, false); w.Code != http.StatusNoContent {
+		t.Fatalf("request from another IP address returned %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	w = limitedRequest("192.0.2.3", cookie, true)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the session limit returned %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("Retry-After is %q, want %q", retry, "1")
+	}
+	var body struct {
+		Error      string `json:"error"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error != "rate_limited" || body.RetryAfter != 1 {
+		t.Errorf("API response is %+v, want rate_limited with retry_after 1", body)
+	}
+
+	// The session limit didn't use up the IP address's token either.
+	advance(time.Second)
+	if w := limitedRequest("192.0.2.3", nil, false); w.Code != http.StatusNoContent {
+		t.Errorf("request without the session returned %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestRateLimitNewVisitors(t *testing.T) {
+	useRateLimits(t, RouteLimits{
+		PerIP:      &Limit{Requests: 1, Per: duration(time.Minute)},
+		PerSession: &Limit{Requests: 1, Per: duration(time.Minute)},
+	})
+
+	// Visitors without a session are only limited by IP address.
+	if w := limitedRequest("192.0.2.1", nil, false); w.Code != http.StatusNoContent {
+		t.Fatalf("first request returned %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := limitedRequest("192.0.2.1", nil, false); w.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the IP limit returned %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// allowedReturnTo reports whether raw is a local path that users may be sent
+// back to after signing in. Only paths matching, or nested under, one of the
+// configured return-to paths are accepted, so the parameter cannot be used
+// as an open redirect.
+func allowedReturnTo(raw string) bool {
+	// Reject anything a browser could treat as another origin, such as
+	// "//evil.com" or "/\evil.com".
+	if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") || strings.ContainsAny(raw, "\\\r\n") {
+		return false
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return false
+	}
+
+	cleaned := path.Clean(u.Path)
+	for _, allowed := range strings.Split(conf.ReturnToPaths, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "" {
+			continue
+		}
+		if cleaned == allowed || strings.HasPrefix(cleaned, strings.TrimSuffix(allowed, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rememberReturnTo records where the user was heading so that login can
+// carry it through the authorization request. It reports whether the
+// destination is allowed, and so recorded.
+func rememberReturnTo(session *sessions.Session, returnTo string) bool {
+	if !allowedReturnTo(returnTo) {
+		return false
+	}
+
+	session.Values["return_to"] = returnTo
+	return true
+}
+
+// takeReturnTo returns and forgets the destination recorded for the session.
+func takeReturnTo(session *sessions.Session) string {
+	returnTo, _ := session.Values["return_to"].(string)
+	delete(session.Values, "return_to")
+	return returnTo
+}
+
+// encodeReturnTo appends the destination to a state value. The whole state is
+// bound to the session, so the destination cannot be swapped in transit.
+func encodeReturnTo(state, returnTo string) string {
+	if returnTo == "" {
+		return state
+	}
+
+	return state + "." + base64.RawURLEncoding.EncodeToString([]byte(returnTo))
+}
+
+// decodeReturnTo extracts the destination from a verified state value. It is
+// validated again in case the allowlist changed during the login.
+func decodeReturnTo(state string) string {
+	i := strings.Index(state, ".")
+	if i < 0 {
+		return ""
+	}
+
+	returnTo, err := base64.RawURLEncoding.DecodeString(state[i+1:])
+	if err != nil || !allowedReturnTo(string(returnTo)) {
+		return ""
+	}
+
+	return string(returnTo)
+}
+
+// redirectToSignin sends an unauthenticated user to the login page,
+// remembering the page they asked for.
+func redirectToSignin(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	// Nothing is saved for the pages users can't be sent back to, so that
+	// crawlers don't create a session for every path they try.
+	if rememberReturnTo(session, r.URL.RequestURI()) {
+		if err := session.Save(r, w); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	http.Redirect(w, r, "/signin", http.StatusSeeOther)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+// RoleRule grants roles to profiles matching every condition that is set.
+// A rule without conditions matches everyone.
+type RoleRule struct {
+	Roles []string `json:"roles"`
+
+	// Group matches profiles that are members of the group.
+	Group string `json:"group,omitempty"`
+
+	// ConnectionType, Connection and Organization match the profile's
+	// connection type, connection ID and organization ID.
+	ConnectionType string `json:"connection_type,omitempty"`
+	Connection     string `json:"connection,omitempty"`
+	Organization   string `json:"organization,omitempty"`
+
+	// Attribute matches profiles whose raw attribute of that name equals
+	// Equals, or contains it when the attribute is a list. Without Equals,
+	// the attribute only needs to be present and not empty.
+	Attribute string `json:"attribute,omitempty"`
+	Equals    string `json:"equals,omitempty"`
+}
+
+// RoleRules map SSO profiles to application roles.
+type RoleRules struct {
+	// DefaultRoles are granted to every signed in user.
+	DefaultRoles []string   `json:"default_roles"`
+	Rules        []RoleRule `json:"rules"`
+}
+
+// roleRules are loaded from conf.RolesFile at startup.
+var roleRules = RoleRules{DefaultRoles: []string{"member"}}
+
+func loadRoleRules(path string) (RoleRules, error) {
+	if path == "" {
+		return roleRules, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return RoleRules{}, err
+	}
+
+	var rules RoleRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return RoleRules{}, err
+	}
+
+	for i, rule := range rules.Rules {
+		if len(rule.Roles) == 0 {
+			return RoleRules{}, fmt.Errorf("rule %d grants no roles", i)
+		}
+	}
+
+	return rules, nil
+}
+
+// attributeValues flattens a raw attribute into the strings it holds.
+func attributeValues(v interface{}) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, attributeValues(item)...)
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func (rule RoleRule) matches(profile sso.Profile) bool {
+	if rule.ConnectionType != "" && rule.ConnectionType != string(profile.ConnectionType) {
+		return false
+	}
+	if rule.Connection != "" && rule.Connection != profile.ConnectionID {
+		return false
+	}
+	if rule.Organization != "" && rule.Organization != profile.OrganizationID {
+		return false
+	}
+
+	if rule.Group != "" {
+		found := false
+		for _, group := range profile.Groups {
+			if strings.EqualFold(group, rule.Group) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if rule.Attribute != "" {
+		values := attributeValues(profile.RawAttributes[rule.Attribute])
+		if len(values) == 0 {
+			return false
+		}
+
+		if rule.Equals != "" {
+			found := false
+			for _, value := range values {
+				if strings.EqualFold(value, rule.Equals) {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Roles returns the sorted roles granted to the profile.
+func (r RoleRules) Roles(profile sso.Profile) []string {
+	granted := map[string]bool{}
+	for _, role := range r.DefaultRoles {
+		granted[role] = true
+	}
+
+	for _, rule := range r.Rules {
+		if rule.matches(profile) {
+			for _, role := range rule.Roles {
+				granted[role] = true
+			}
+		}
+	}
+
+	roles := make([]string, 0, len(granted))
+	for role := range granted {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	return roles
+}
+
+// sessionRoles returns the roles saved in the session when the user signed in.
+func sessionRoles(session *sessions.Session) []string {
+	roles, _ := session.Values["roles"].([]string)
+	return roles
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RequireRole only lets through signed in users that have the role. Other
+// signed in users get a 403.
+func RequireRole(role string, next http.Handler) http.Handler {
+	return RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "cookie-name")
+
+		if !hasRole(sessionRoles(session), role) {
+			if isAPIRequest(r) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error":   "forbidden",
+					"message": "This resource requires the " + role + " role.",
+				})
+				return
+			}
+
+			renderError(w, http.StatusForbidden, "You don't have access to this page",
+				"This page requires the "+role+" role. Ask your administrator for access.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// admin is a page only users with the admin role can see.
+func admin(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("./static/admin.html", "./static/impersonation_banner.html"))
+	session, _ := store.Get(r, "cookie-name")
+
+	if err := tmpl.Execute(w, sessionProfile(session)); err != nil {
+		log.Panic(err)
+	}
+}
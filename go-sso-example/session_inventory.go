@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// ActiveSession describes a signed in session for the session pages.
+type ActiveSession struct {
+	// Handle identifies the session in forms without revealing its ID.
+	Handle string
+
+	UserID         int64
+	Name           string
+	Email          string
+	ConnectionID   string
+	ConnectionType string
+	UserAgent      string
+	IP             string
+	CreatedAt      time.Time
+	LastSeenAt     time.Time
+
+	// Impersonator is the email of the admin impersonating the user.
+	Impersonator string
+
+	// Current is set for the session of the request listing them.
+	Current bool
+
+	id string
+}
+
+// SessionsPage is rendered by static/sessions.html.
+type SessionsPage struct {
+	Impersonation *Impersonation
+
+	Admin    bool
+	UserID   string
+	Sessions []ActiveSession
+}
+
+// sessionHandle derives the public handle of a session ID.
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// recordSessionDevice saves where the user signed in from in the session. It
+// must be saved by the caller.
+func recordSessionDevice(session *sessions.Session, r *http.Request) {
+	session.Values["user_agent"] = r.UserAgent()
+	session.Values["ip"] = clientIP(r)
+}
+
+// activeSessions returns the signed in sessions that have not expired, most
+// recently used first, optionally only those of one user.
+func activeSessions(userID int64) ([]ActiveSession, error) {
+	list, err := store.backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var active []ActiveSession
+
+	for id, data := range list {
+		session := &sessions.Session{ID: id, Values: map[interface{}]interface{}{}}
+		if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+			log.Printf("skipping unreadable session: %s", err)
+			continue
+		}
+
+		if auth, _ := session.Values["authenticated"].(bool); !auth || sessionExpired(session, now) {
+			continue
+		}
+
+		uid, _ := session.Values["user_id"].(int64)
+		if userID != 0 && uid != userID {
+			continue
+		}
+
+		createdAt, _ := session.Values["authenticated_at"].(int64)
+		lastSeenAt, _ := session.Values["last_seen_at"].(int64)
+		userAgent, _ := session.Values["user_agent"].(string)
+		ip, _ := session.Values["ip"].(string)
+
+		s := ActiveSession{
+			Handle:     sessionHandle(id),
+			UserID:     uid,
+			UserAgent:  userAgent,
+			IP:         ip,
+			CreatedAt:  time.Unix(createdAt, 0),
+			LastSeenAt: time.Unix(lastSeenAt, 0),
+			id:         id,
+		}
+		if profile, ok := sessionSSOProfile(session); ok {
+			s.Name = profile.FirstName + " " + profile.LastName
+			s.Email = profile.Email
+			s.ConnectionID = profile.ConnectionID
+			s.ConnectionType = string(profile.ConnectionType)
+		}
+
+		if imp := sessionImpersonation(session); imp != nil {
+			s.Impersonator = imp.Admin.Email
+		}
+
+		active = append(active, s)
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].LastSeenAt.After(active[j].LastSeenAt)
+	})
+
+	return active, nil
+}
+
+// revokeSessions deletes the sessions and reports whether the one of the
+// request was among them, in which case its cookie is cleared too.
+func revokeSessions(w http.ResponseWriter, r *http.Request, revoked []ActiveSession) bool {
+	current, _ := store.Get(r, "cookie-name")
+
+	signedOut := false
+	for _, s := range revoked {
+		if s.id == current.ID {
+			current.Options.MaxAge = -1
+			if err := current.Save(r, w); err != nil {
+				log.Panic(err)
+			}
+			signedOut = true
+			continue
+		}
+
+		if err := store.backend.Delete(s.id); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	return signedOut
+}
+
+func renderSessions(w http.ResponseWriter, r *http.Request, page SessionsPage) {
+	current, _ := store.Get(r, "cookie-name")
+	for i := range page.Sessions {
+		page.Sessions[i].Current = page.Sessions[i].id == current.ID
+	}
+
+	page.Impersonation = sessionImpersonation(current)
+
+	tmpl := template.Must(template.ParseFiles("./static/sessions.html", "./static/impersonation_banner.html"))
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Panic(err)
+	}
+}
+
+// mySessions lists the sessions of the signed in user.
+func mySessions(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "cookie-name")
+	userID, _ := session.Values["user_id"].(int64)
+
+	list, err := activeSessions(userID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	renderSessions(w, r, SessionsPage{Sessions: list})
+}
+
+// revokeMySession signs the user out of one of their sessions, given by its
+// handle, or of all of them.
+func revokeMySession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	userID, _ := session.Values["user_id"].(int64)
+
+	list, err := activeSessions(userID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	handle := r.FormValue("session")
+	all := r.FormValue("all") == "true"
+
+	var revoked []ActiveSession
+	for _, s := range list {
+		if all || s.Handle == handle {
+			revoked = append(revoked, s)
+		}
+	}
+
+	log.Printf("user %d revoked %d sessions", userID, len(revoked))
+
+	if revokeSessions(w, r, revoked) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+}
+
+// adminSessions lists the sessions of every user, or of the user given by
+// the user_id parameter.
+func adminSessions(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.ParseInt(r.URL.Query().Get("user_id"), 10, 64)
+
+	list, err := activeSessions(userID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	page := SessionsPage{Admin: true, Sessions: list}
+	if userID != 0 {
+		page.UserID = strconv.FormatInt(userID, 10)
+	}
+
+	renderSessions(w, r, page)
+}
+
+// adminRevokeSessions signs a user out of every device, given the user_id,
+// or revokes a single session given its handle.
+func adminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.ParseInt(r.FormValue("user_id"), 10, 64)
+	handle := r.FormValue("session")
+	if userID == 0 && handle == "" {
+		renderError(w, http.StatusBadRequest, "Nothing to sign out",
+			"Choose a user or a session to sign out.")
+		return
+	}
+
+	list, err := activeSessions(userID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var revoked []ActiveSession
+	for _, s := range list {
+		if handle == "" || s.Handle == handle {
+			revoked = append(revoked, s)
+		}
+	}
+
+	admin, _ := store.Get(r, "cookie-name")
+	log.Printf("admin %v revoked %d sessions of user %d", admin.Values["user_id"], len(revoked), userID)
+
+	if revokeSessions(w, r, revoked) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	back := "/admin/sessions"
+	if userID != 0 {
+		back += "?user_id=" + strconv.FormatInt(userID, 10)
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
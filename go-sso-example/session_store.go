@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// browserSessionLifetime is how long sessions whose cookie has no MaxAge are
+// kept on the server.
+const browserSessionLifetime = 24 * time.Hour
+
+// anonymousSessionLifetime is how long the sessions of users who haven't
+// signed in are kept on the server. They hold little more than a login in
+// progress, and every visitor gets one, so they must not pile up.
+const anonymousSessionLifetime = time.Hour
+
+var errSessionNotFound = errors.New("session not found")
+
+// SessionStore persists session data on the server, keyed by session ID. The
+// browser cookie only carries the signed ID, so deleting a session revokes
+// it no matter which cookie copies are still around.
+type SessionStore interface {
+	// Load returns the data saved for the session, or errSessionNotFound if
+	// it does not exist or has expired.
+	Load(id string) ([]byte, error)
+
+	// Save creates or replaces the data saved for the session.
+	Save(id string, data []byte, expiresAt time.Time) error
+
+	// Update replaces the data saved for a session that exists and has not
+	// expired, and returns errSessionNotFound otherwise. It keeps a request
+	// that loaded a session before it was revoked from bringing it back.
+	Update(id string, data []byte, expiresAt time.Time) error
+
+	// Delete revokes the session.
+	Delete(id string) error
+
+	// DeleteExpired removes every session that has expired.
+	DeleteExpired() error
+
+	// List returns the data of every session that has not expired, keyed by
+	// session ID.
+	List() (map[string][]byte, error)
+}
+
+// newSessionStore returns the backend selected by name. path is the directory
+// used by the file backend and the database used by the sqlite backend.
+func newSessionStore(name, path string) (SessionStore, error) {
+	switch name {
+	case "memory":
+		return newMemorySessionStore(), nil
+	case "file":
+		return newFileSessionStore(path)
+	case "sqlite":
+		return newSQLiteSessionStore(path)
+	default:
+		return nil, fmt.Errorf("unknown session store %q", name)
+	}
+}
+
+// sessionKeys parses a comma separated list of signing keys. The first key
+// signs new cookies; all of them are accepted when verifying, so a key can be
+// rotated by putting the new key first and dropping the old one once every
+// cookie signed with it has expired.
+func sessionKeys(list string) [][]byte {
+	var keys [][]byte
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, []byte(key))
+		}
+	}
+
+	if len(keys) == 0 {
+		log.Print("No session keys configured, using a random key; sessions will not survive a restart")
+		keys = append(keys, securecookie.GenerateRandomKey(32))
+	}
+
+	return keys
+}
+
+// serverStore is a gorilla sessions.Store that keeps session values in a
+// SessionStore and only the signed session ID in the cookie.
+type serverStore struct {
+	backend SessionStore
+	codecs  []securecookie.Codec
+	options *sessions.Options
+}
+
+func newServerStore(backend SessionStore, keys [][]byte, options *sessions.Options) *serverStore {
+	// Keys are used as hash keys only, the cookie holds nothing but an ID.
+	var pairs [][]byte
+	for _, key := range keys {
+		pairs = append(pairs, key, nil)
+	}
+
+	s := &serverStore{
+		backend: backend,
+		codecs:  securecookie.CodecsFromPairs(pairs...),
+		options: options,
+	}
+
+	for _, codec := range s.codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(s.options.MaxAge)
+		}
+	}
+
+	return s
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *serverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session named by the request cookie, or a new session when
+// there is no cookie or the session it names has been revoked.
+func (s *serverStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.codecs...); err != nil {
+		session.ID = ""
+		return session, err
+	}
+
+	data, err := s.backend.Load(session.ID)
+	if err == errSessionNotFound {
+		session.ID = ""
+		return session, nil
+	}
+	if err != nil {
+		session.ID = ""
+		return session, err
+	}
+
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		session.ID = ""
+		return session, err
+	}
+
+	session.IsNew = false
+	return session, nil
+}
+
+// Save persists the session and sets its cookie. A session with a negative
+// MaxAge is revoked and its cookie cleared, and so is a session that was
+// revoked since it was loaded.
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+
+	// Browser-session cookies still need an end date on the server.
+	lifetime := time.Duration(session.Options.MaxAge) * time.Second
+	if lifetime == 0 {
+		lifetime = browserSessionLifetime
+	}
+	if auth, _ := session.Values["authenticated"].(bool); !auth && lifetime > anonymousSessionLifetime {
+		lifetime = anonymousSessionLifetime
+	}
+	expiresAt := time.Now().Add(lifetime)
+
+	// Sessions only have an ID once they were loaded or saved, new ones
+	// get a fresh ID that nobody else can be using.
+	if session.ID == "" {
+		session.ID = randomToken(32)
+		err = s.backend.Save(session.ID, data, expiresAt)
+	} else {
+		err = s.backend.Update(session.ID, data, expiresAt)
+	}
+	if err == errSessionNotFound {
+		log.Printf("session was revoked while in use, signing out")
+		session.ID = ""
+		session.Values = map[interface{}]interface{}{}
+		opts := *session.Options
+		opts.MaxAge = -1
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", &opts))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew moves the session to a new ID, revoking the old one. It is called
+// when a user signs in so that a session ID planted before the login cannot
+// be used afterwards.
+func (s *serverStore) Renew(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := s.backend.Delete(session.ID); err != nil {
+			return err
+		}
+	}
+
+	session.ID = ""
+	return nil
+}
+
+// cleanupSessions removes expired sessions from the backend every interval.
+func cleanupSessions(backend SessionStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := backend.DeleteExpired(); err != nil {
+			log.Printf("deleting expired sessions failed: %s", err)
+		}
+	}
+}
+
+type storedSession struct {
+	Data      []byte
+	ExpiresAt time.Time
+}
+
+// memorySessionStore keeps sessions in memory. They are lost on restart and
+// not shared between instances.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]storedSession
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]storedSession)}
+}
+
+func (m *memorySessionStore) Load(id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || time.Now().After(s.ExpiresAt) {
+		return nil, errSessionNotFound
+	}
+
+	return s.Data, nil
+}
+
+func (m *memorySessionStore) Save(id string, data []byte, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[id] = storedSession{data, expiresAt}
+	return nil
+}
+
+func (m *memorySessionStore) Update(id string, data []byte, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || time.Now().After(s.ExpiresAt) {
+		return errSessionNotFound
+	}
+
+	m.sessions[id] = storedSession{data, expiresAt}
+	return nil
+}
+
+func (m *memorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memorySessionStore) DeleteExpired() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, s := range m.sessions {
+		if now.After(s.ExpiresAt) {
+			delete(m.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+func (m *memorySessionStore) List() (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	list := make(map[string][]byte)
+	for id, s := range m.sessions {
+		if !now.After(s.ExpiresAt) {
+			list[id] = s.Data
+		}
+	}
+
+	return list, nil
+}
+
+// sessionIDPattern matches the IDs generated by serverStore. IDs are checked
+// before being used as file names.
+var sessionIDPattern = regexp.MustCompile("^[0-9a-f]+$")
+
+// fileSessionStore keeps one file per session in a directory.
+type fileSessionStore struct {
+	mu  sync.RWMutex
+	dir string
+}
+
+func newFileSessionStore(dir string) (*fileSessionStore, error) {
+	if dir == "" {
+		dir = "sessions"
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileSessionStore{dir: dir}, nil
+}
+
+func (f *fileSessionStore) filename(id string) (string, error) {
+	if !sessionIDPattern.MatchString(id) {
+		return "", errSessionNotFound
+	}
+
+	return filepath.Join(f.dir, "session_"+id), nil
+}
+
+func (f *fileSessionStore) read(filename string) (storedSession, error) {
+	var s storedSession
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return s, err
+	}
+	defer file.Close()
+
+	err = gob.NewDecoder(file).Decode(&s)
+	return s, err
+}
+
+func (f *fileSessionStore) Load(id string) ([]byte, error) {
+	filename, err := f.filename(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	s, err := f.read(filename)
+	if os.IsNotExist(err) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, errSessionNotFound
+	}
+
+	return s.Data, nil
+}
+
+func (f *fileSessionStore) Save(id string, data []byte, expiresAt time.Time) error {
+	filename, err := f.filename(id)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.write(filename, data, expiresAt)
+}
+
+func (f *fileSessionStore) Update(id string, data []byte, expiresAt time.Time) error {
+	filename, err := f.filename(id)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, err := f.read(filename)
+	if os.IsNotExist(err) || err == nil && time.Now().After(s.ExpiresAt) {
+		return errSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.write(filename, data, expiresAt)
+}
+
+// write saves the session to the file. f.mu must be locked.
+func (f *fileSessionStore) write(filename string, data []byte, expiresAt time.Time) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(file).Encode(storedSession{data, expiresAt}); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (f *fileSessionStore) Delete(id string) error {
+	filename, err := f.filename(id)
+	if err != nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (f *fileSessionStore) DeleteExpired() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, info := range files {
+		if !strings.HasPrefix(info.Name(), "session_") {
+			continue
+		}
+
+		filename := filepath.Join(f.dir, info.Name())
+		s, err := f.read(filename)
+		if err != nil || now.After(s.ExpiresAt) {
+			os.Remove(filename)
+		}
+	}
+
+	return nil
+}
+
+func (f *fileSessionStore) List() (map[string][]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	list := make(map[string][]byte)
+	for _, info := range files {
+		id := strings.TrimPrefix(info.Name(), "session_")
+		if id == info.Name() || !sessionIDPattern.MatchString(id) {
+			continue
+		}
+
+		s, err := f.read(filepath.Join(f.dir, info.Name()))
+		if err != nil || now.After(s.ExpiresAt) {
+			continue
+		}
+		list[id] = s.Data
+	}
+
+	return list, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSessionStore keeps sessions in a SQLite database, which can be shared
+// by several instances running on the same machine.
+type sqliteSessionStore struct {
+	db *sql.DB
+}
+
+func newSQLiteSessionStore(path string) (*sqliteSessionStore, error) {
+	if path == "" {
+		path = "sessions.db"
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		id         TEXT PRIMARY KEY,
+		data       BLOB NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteSessionStore{db: db}, nil
+}
+
+func (s *sqliteSessionStore) Load(id string) ([]byte, error) {
+	var data []byte
+
+	err := s.db.QueryRow(
+		`SELECT data FROM sessions WHERE id = ? AND expires_at > ?`,
+		id, time.Now().Unix(),
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errSessionNotFound
+	}
+
+	return data, err
+}
+
+func (s *sqliteSessionStore) Save(id string, data []byte, expiresAt time.Time) error {
+	_, err := s.db.Exec(
+		`INSERT INTO sessions (id, data, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data, expires_at = excluded.expires_at`,
+		id, data, expiresAt.Unix(),
+	)
+	return err
+}
+
+func (s *sqliteSessionStore) Update(id string, data []byte, expiresAt time.Time) error {
+	res, err := s.db.Exec(
+		`UPDATE sessions SET data = ?, expires_at = ? WHERE id = ? AND expires_at > ?`,
+		data, expiresAt.Unix(), id, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errSessionNotFound
+	}
+
+	return nil
+}
+
+func (s *sqliteSessionStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqliteSessionStore) DeleteExpired() error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, time.Now().Unix())
+	return err
+}
+
+func (s *sqliteSessionStore) List() (map[string][]byte, error) {
+	rows, err := s.db.Query(`SELECT id, data FROM sessions WHERE expires_at > ?`, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make(map[string][]byte)
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		list[id] = data
+	}
+
+	return list, rows.Err()
+}
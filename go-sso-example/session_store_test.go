@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestSessionStoreUpdate(t *testing.T) {
+	dir := t.TempDir()
+
+	files, err := newFileSessionStore(filepath.Join(dir, "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := newSQLiteSessionStore(filepath.Join(dir, "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.db.Close() })
+
+	backends := map[string]SessionStore{
+		"memory": newMemorySessionStore(),
+		"file":   files,
+		"sqlite": db,
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			expiresAt := time.Now().Add(time.Hour)
+			missing, expired, id := randomToken(32), randomToken(32), randomToken(32)
+
+			if err := backend.Update(missing, []byte("data"), expiresAt); err != errSessionNotFound {
+				t.Fatalf("updating a missing session returned %v, want %v", err, errSessionNotFound)
+			}
+			if _, err := backend.Load(missing); err != errSessionNotFound {
+				t.Fatalf("updating a missing session created it")
+			}
+
+			if err := backend.Save(expired, []byte("data"), time.Now().Add(-time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Update(expired, []byte("data"), expiresAt); err != errSessionNotFound {
+				t.Fatalf("updating an expired session returned %v, want %v", err, errSessionNotFound)
+			}
+
+			if err := backend.Save(id, []byte("first"), expiresAt); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Update(id, []byte("second"), expiresAt); err != nil {
+				t.Fatal(err)
+			}
+			data, err := backend.Load(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, []byte("second")) {
+				t.Errorf("loaded %q after the update, want %q", data, "second")
+			}
+
+			if err := backend.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Update(id, []byte("third"), expiresAt); err != errSessionNotFound {
+				t.Errorf("updating a deleted session returned %v, want %v", err, errSessionNotFound)
+			}
+			if _, err := backend.Load(id); err != errSessionNotFound {
+				t.Errorf("updating a deleted session brought it back")
+			}
+		})
+	}
+}
+
+// newTestServerStore returns a server store keeping sessions in memory for
+// 30 days.
+func newTestServerStore() (*serverStore, *memorySessionStore) {
+	backend := newMemorySessionStore()
+	store := newServerStore(backend, [][]byte{[]byte("test-session-key")}, &sessions.Options{
+		Path:   "/",
+		MaxAge: 30 * 24 * 60 * 60,
+	})
+
+	return store, backend
+}
+
+// saveTestSession saves the session and returns the cookie it set.
+func saveTestSession(t *testing.T, store *serverStore, session *sessions.Session) *http.Cookie {
+	w := httptest.NewRecorder()
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), w, session); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("saving the session set %d cookies, want 1", len(cookies))
+	}
+
+	return cookies[0]
+}
+
+// loadTestSession loads the session the cookie names, as a new request would.
+func loadTestSession(t *testing.T, store *serverStore, cookie *http.Cookie) *sessions.Session {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+
+	session, err := store.New(r, cookie.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return session
+}
+
+func TestServerStoreRevokedSession(t *testing.T) {
+	store, backend := newTestServerStore()
+
+	session := sessions.NewSession(store, "sso-example-session")
+	opts := *store.options
+	session.Options = &opts
+	session.Values["authenticated"] = true
+	cookie := saveTestSession(t, store, session)
+
+	// A request loads the session, which is then revoked from another one
+	// before the first request saves it.
+	loaded := loadTestSession(t, store, cookie)
+	if loaded.IsNew {
+		t.Fatal("the saved session wasn't loaded")
+	}
+	if err := backend.Delete(loaded.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded.Values["last_seen_at"] = time.Now().Unix()
+	cleared := saveTestSession(t, store, loaded)
+	if cleared.MaxAge >= 0 {
+		t.Errorf("saving a revoked session set a cookie with MaxAge %d, want it cleared", cleared.MaxAge)
+	}
+	if _, err := backend.Load(session.ID); err != errSessionNotFound {
+		t.Error("saving a revoked session brought it back")
+	}
+	if len(backend.sessions) != 0 {
+		t.Errorf("saving a revoked session stored %d sessions, want none", len(backend.sessions))
+	}
+
+	if again := loadTestSession(t, store, cookie); !again.IsNew {
+		t.Error("the revoked session can still be loaded")
+	}
+}
+
+func TestServerStoreLifetime(t *testing.T) {
+	tests := []struct {
+		name          string
+		authenticated bool
+		lifetime      time.Duration
+	}{
+		{"anonymous", false, anonymousSessionLifetime},
+		{"authenticated", true, 30 * 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, backend := newTestServerStore()
+
+			session := sessions.NewSession(store, "sso-example-session")
+			opts := *store.options
+			session.Options = &opts
+			session.Values["return_to"] = "/logged_in"
+			if test.authenticated {
+				session.Values["authenticated"] = true
+			}
+
+			start := time.Now()
+			saveTestSession(t, store, session)
+
+			lifetime := backend.sessions[session.ID].ExpiresAt.Sub(start)
+			if lifetime < test.lifetime || lifetime > test.lifetime+time.Minute {
+				t.Errorf("session is kept for %s, want %s", lifetime, test.lifetime)
+			}
+		})
+	}
+}
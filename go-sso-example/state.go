@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// stateLifetime is how long a user has to complete a login once it has been
+// started.
+const stateLifetime = 10 * time.Minute
+
+var (
+	errStateMissing  = errors.New("no login is in progress for this session")
+	errStateMismatch = errors.New("state parameter does not match the session")
+	errStateExpired  = errors.New("state parameter has expired")
+)
+
+// newLoginState generates the `state` sent with the authorization URL, carrying
+// the optional return-to path, and binds it to the session. It must be saved
+// along with the session.
+func newLoginState(session *sessions.Session, returnTo string) string {
+	state := encodeReturnTo(randomToken(32), returnTo)
+	session.Values["oauth_state"] = state
+	session.Values["oauth_state_expires_at"] = time.Now().Add(stateLifetime).Unix()
+	return state
+}
+
+// verifyLoginState checks the `state` returned to the callback against the one
+// bound to the session. The stored state is removed whatever the outcome, so
+// each state can only be used once; the caller must save the session.
+func verifyLoginState(session *sessions.Session, state string) error {
+	expected, _ := session.Values["oauth_state"].(string)
+	expiresAt, _ := session.Values["oauth_state_expires_at"].(int64)
+
+	delete(session.Values, "oauth_state")
+	delete(session.Values, "oauth_state_expires_at")
+
+	if expected == "" {
+		return errStateMissing
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(state)) != 1 {
+		return errStateMismatch
+	}
+	if time.Now().Unix() > expiresAt {
+		return errStateExpired
+	}
+
+	return nil
+}
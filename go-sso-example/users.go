@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/workos/workos-go/v3/pkg/sso"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// User is an account provisioned from an SSO profile the first time its
+// owner signs in.
+type User struct {
+	ID             int64
+	ProfileID      string
+	ConnectionID   string
+	ConnectionType string
+	OrganizationID string
+	Email          string
+	FirstName      string
+	LastName       string
+	Groups         []string
+	RawAttributes  map[string]interface{}
+	FirstLoginAt   time.Time
+	LastLoginAt    time.Time
+	LoginCount     int
+
+	// LinkedTo is the ID of the user this one was linked to. Signing in
+	// with a linked user signs in as the user it is linked to.
+	LinkedTo int64
+}
+
+// UserRepository stores the users provisioned from SSO profiles. Users are
+// identified by their profile ID and connection.
+type UserRepository interface {
+	// Upsert creates the user for the profile, or updates it with the
+	// latest profile attributes, and records a login at the given time.
+	Upsert(profile sso.Profile, at time.Time) (User, error)
+
+	// Get returns the user with the given ID, or errUserNotFound.
+	Get(id int64) (User, error)
+
+	// List returns every user, most recently signed in first.
+	List() ([]User, error)
+
+	// FindByEmail returns the users with the email, compared without
+	// regard to case, that are not linked to another user.
+	FindByEmail(email string) ([]User, error)
+
+	// Linked returns the users linked to the user with the given ID.
+	Linked(id int64) ([]User, error)
+
+	// Link links the user to another, along with every user linked to it.
+	// Linking it to zero unlinks it.
+	Link(id, to int64) error
+}
+
+// newUserRepository returns the repository selected by name. path is the
+// database used by the sqlite repository.
+func newUserRepository(name, path string) (UserRepository, error) {
+	switch name {
+	case "memory":
+		return newMemoryUserRepository(), nil
+	case "sqlite":
+		return newSQLiteUserRepository(path)
+	default:
+		return nil, fmt.Errorf("unknown user store %q", name)
+	}
+}
+
+// users holds the provisioned users.
+var users UserRepository
+
+// provisionUser creates or updates the local user for a profile that just
+// signed in.
+func provisionUser(profile sso.Profile) (User, error) {
+	user, err := users.Upsert(profile, time.Now())
+	if err != nil {
+		return User{}, err
+	}
+
+	if user.LoginCount == 1 {
+		log.Printf("provisioned user %d for %s (%s)", user.ID, user.Email, user.ConnectionID)
+	}
+
+	return user, nil
+}
+
+// resolveUser returns the user that signing in as user signs in as.
+func resolveUser(user User) (User, error) {
+	if user.LinkedTo == 0 {
+		return user, nil
+	}
+
+	return users.Get(user.LinkedTo)
+}
+
+// applyProfile copies the profile attributes that may change between logins.
+func (u *User) applyProfile(profile sso.Profile) {
+	u.ConnectionType = string(profile.ConnectionType)
+	u.OrganizationID = profile.OrganizationID
+	u.Email = profile.Email
+	u.FirstName = profile.FirstName
+	u.LastName = profile.LastName
+	u.Groups = profile.Groups
+	u.RawAttributes = profile.RawAttributes
+}
+
+// Profile rebuilds the SSO profile the user last signed in with.
+func (u User) Profile() sso.Profile {
+	return sso.Profile{
+		ID:             u.ProfileID,
+		ConnectionID:   u.ConnectionID,
+		ConnectionType: sso.ConnectionType(u.ConnectionType),
+		OrganizationID: u.OrganizationID,
+		Email:          u.Email,
+		FirstName:      u.FirstName,
+		LastName:       u.LastName,
+		Groups:         u.Groups,
+		RawAttributes:  u.RawAttributes,
+	}
+}
+
+type userKey struct {
+	profileID    string
+	connectionID string
+}
+
+// memoryUserRepository keeps users in memory. They are lost on restart.
+type memoryUserRepository struct {
+	mu     sync.Mutex
+	nextID int64
+	users  map[userKey]*User
+}
+
+func newMemoryUserRepository() *memoryUserRepository {
+	return &memoryUserRepository{nextID: 1, users: make(map[userKey]*User)}
+}
+
+func (m *memoryUserRepository) Upsert(profile sso.Profile, at time.Time) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := userKey{profile.ID, profile.ConnectionID}
+	user, ok := m.users[key]
+	if !ok {
+		user = &User{
+			ID:           m.nextID,
+			ProfileID:    profile.ID,
+			ConnectionID: profile.ConnectionID,
+			FirstLoginAt: at,
+		}
+		m.nextID++
+		m.users[key] = user
+	}
+
+	user.applyProfile(profile)
+	user.LastLoginAt = at
+	user.LoginCount++
+
+	return *user, nil
+}
+
+func (m *memoryUserRepository) Get(id int64) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if user.ID == id {
+			return *user, nil
+		}
+	}
+
+	return User{}, errUserNotFound
+}
+
+func (m *memoryUserRepository) List() ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]User, 0, len(m.users))
+	for _, user := range m.users {
+		list = append(list, *user)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastLoginAt.After(list[j].LastLoginAt)
+	})
+
+	return list, nil
+}
+
+func (m *memoryUserRepository) FindByEmail(email string) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var list []User
+	for _, user := range m.users {
+		if user.LinkedTo == 0 && strings.EqualFold(user.Email, email) {
+			list = append(list, *user)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastLoginAt.After(list[j].LastLoginAt)
+	})
+
+	return list, nil
+}
+
+func (m *memoryUserRepository) Linked(id int64) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var list []User
+	for _, user := range m.users {
+		if user.LinkedTo == id {
+			list = append(list, *user)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].FirstLoginAt.Before(list[j].FirstLoginAt)
+	})
+
+	return list, nil
+}
+
+func (m *memoryUserRepository) Link(id, to int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := false
+	for _, user := range m.users {
+		if user.ID == id {
+			user.LinkedTo = to
+			found = true
+		} else if to != 0 && user.LinkedTo == id {
+			user.LinkedTo = to
+		}
+	}
+
+	if !found {
+		return errUserNotFound
+	}
+
+	return nil
+}
+
+// sqliteUserRepository keeps users in a SQLite database.
+type sqliteUserRepository struct {
+	db *sql.DB
+}
+
+func newSQLiteUserRepository(path string) (*sqliteUserRepository, error) {
+	if path == "" {
+		path = "users.db"
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		profile_id      TEXT NOT NULL,
+		connection_id   TEXT NOT NULL,
+		connection_type TEXT NOT NULL,
+		organization_id TEXT NOT NULL,
+		email           TEXT NOT NULL,
+		first_name      TEXT NOT NULL,
+		last_name       TEXT NOT NULL,
+		groups          TEXT NOT NULL,
+		raw_attributes  TEXT NOT NULL,
+		first_login_at  INTEGER NOT NULL,
+		last_login_at   INTEGER NOT NULL,
+		login_count     INTEGER NOT NULL,
+		linked_to       INTEGER NOT NULL DEFAULT 0,
+		UNIQUE (profile_id, connection_id)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Databases created before accounts could be linked lack the column.
+	linked, err := hasColumn(db, "users", "linked_to")
+	if err == nil && !linked {
+		_, err = db.Exec(`ALTER TABLE users ADD COLUMN linked_to INTEGER NOT NULL DEFAULT 0`)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteUserRepository{db: db}, nil
+}
+
+// hasColumn reports whether the table has a column of that name.
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+const userColumns = `id, profile_id, connection_id, connection_type, organization_id,
+	email, first_name, last_name, groups, raw_attributes,
+	first_login_at, last_login_at, login_count, linked_to`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var groups, rawAttributes string
+	var firstLoginAt, lastLoginAt int64
+
+	err := row.Scan(
+		&user.ID, &user.ProfileID, &user.ConnectionID, &user.ConnectionType, &user.OrganizationID,
+		&user.Email, &user.FirstName, &user.LastName, &groups, &rawAttributes,
+		&firstLoginAt, &lastLoginAt, &user.LoginCount, &user.LinkedTo,
+	)
+	if err == sql.ErrNoRows {
+		return user, errUserNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+
+	if err := json.Unmarshal([]byte(groups), &user.Groups); err != nil {
+		return user, err
+	}
+	if err := json.Unmarshal([]byte(rawAttributes), &user.RawAttributes); err != nil {
+		return user, err
+	}
+	user.FirstLoginAt = time.Unix(firstLoginAt, 0)
+	user.LastLoginAt = time.Unix(lastLoginAt, 0)
+
+	return user, nil
+}
+
+func (s *sqliteUserRepository) Upsert(profile sso.Profile, at time.Time) (User, error) {
+	groups, err := json.Marshal(profile.Groups)
+	if err != nil {
+		return User{}, err
+	}
+	rawAttributes, err := json.Marshal(profile.RawAttributes)
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO users (
+			profile_id, connection_id, connection_type, organization_id,
+			email, first_name, last_name, groups, raw_attributes,
+			first_login_at, last_login_at, login_count
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT (profile_id, connection_id) DO UPDATE SET
+			connection_type = excluded.connection_type,
+			organization_id = excluded.organization_id,
+			email = excluded.email,
+			first_name = excluded.first_name,
+			last_name = excluded.last_name,
+			groups = excluded.groups,
+			raw_attributes = excluded.raw_attributes,
+			last_login_at = excluded.last_login_at,
+			login_count = login_count + 1`,
+		profile.ID, profile.ConnectionID, string(profile.ConnectionType), profile.OrganizationID,
+		profile.Email, profile.FirstName, profile.LastName, string(groups), string(rawAttributes),
+		at.Unix(), at.Unix(),
+	)
+	if err != nil {
+		return User{}, err
+	}
+
+	return scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE profile_id = ? AND connection_id = ?`,
+		profile.ID, profile.ConnectionID,
+	))
+}
+
+func (s *sqliteUserRepository) Get(id int64) (User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+func (s *sqliteUserRepository) List() ([]User, error) {
+	return s.query(`SELECT ` + userColumns + ` FROM users ORDER BY last_login_at DESC`)
+}
+
+func (s *sqliteUserRepository) query(query string, args ...interface{}) ([]User, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, user)
+	}
+
+	return list, rows.Err()
+}
+
+func (s *sqliteUserRepository) FindByEmail(email string) ([]User, error) {
+	return s.query(
+		`SELECT `+userColumns+` FROM users WHERE email = ? COLLATE NOCASE AND linked_to = 0
+		ORDER BY last_login_at DESC`,
+		email,
+	)
+}
+
+func (s *sqliteUserRepository) Linked(id int64) ([]User, error) {
+	return s.query(`SELECT `+userColumns+` FROM users WHERE linked_to = ? ORDER BY first_login_at`, id)
+}
+
+func (s *sqliteUserRepository) Link(id, to int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE users SET linked_to = ? WHERE id = ?`, to, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUserNotFound
+	}
+
+	if to != 0 {
+		if _, err := tx.Exec(`UPDATE users SET linked_to = ? WHERE linked_to = ?`, to, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UsersPage is rendered by static/users.html.
+type UsersPage struct {
+	Users []User
+
+	Impersonation *Impersonation
+}
+
+// listUsers displays the provisioned users.
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("./static/users.html", "./static/impersonation_banner.html"))
+	session, _ := store.Get(r, "cookie-name")
+
+	list, err := users.List()
+	if err != nil {
+		log.Printf("list users failed: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tmpl.Execute(w, UsersPage{list, sessionImpersonation(session)}); err != nil {
+		log.Panic(err)
+	}
+}